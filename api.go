@@ -20,15 +20,38 @@ type Caller interface {
 // CachedCaller 带缓存的调用
 type CachedCaller interface {
 	Caller
+	Closer
 	Init(caller Caller, opts ...Option) error
 }
 
+// Reconfigurer 在线修改配置
+type Reconfigurer interface {
+	Reconfigure(opts ...Option) error
+}
+
+// Closer 停止后台任务并释放资源
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
 // ReqCodec 请求包编解码
 type ReqCodec interface {
 	Encode(req Req) (items []*Item, err error)
 	Decode(items []*Item) (req Req, err error)
 }
 
+// MissReqBuilder ReqCodec的可选扩展，实现后只用未命中的item重新构造请求时会传入原请求，
+// 用于保留原请求中与key无关的字段，后台更新没有原请求，仍使用Decode
+type MissReqBuilder interface {
+	BuildMissReq(req Req, items []*Item) (missReq Req, err error)
+}
+
+// ItemChecker RspCodec的可选扩展，缓存中的item返回错误时按未命中处理并调用下游，
+// 用于识别记录类型变更前写入的数据
+type ItemChecker interface {
+	CheckItem(item *Item) error
+}
+
 // RspCodec 回包编解码
 type RspCodec interface {
 	Encode(rsp Rsp) (items []*Item, err error)
@@ -90,16 +113,112 @@ const (
 	TransTypeFail
 	// TransTypeTimeout 超时
 	TransTypeTimeout
+	// TransTypeCanceled 调用方取消了ctx，不代表下游失败，不上报给TransCtrl
+	TransTypeCanceled
 )
 
-// TransCtrl 拥塞控制保护下游
+// TransCtrl 拥塞控制保护下游，Reconfigure修改配置时会在运行中再次调用Init
 type TransCtrl interface {
 	Report(t TransType)
 	Degrade() bool
 	Init(config TransCtrlConfig) error
 }
 
+// DegradeChecker TransCtrl的可选扩展，只查询当前是否在降级而不消耗降级名额，
+// 后台更新和异步刷新据此跳过批次，避免占用前台的降级名额；未实现时后台调用只受限流控制
+type DegradeChecker interface {
+	Degrading() bool
+}
+
+// BackgroundReporter TransCtrl的可选扩展，实现后后台调用通过ReportBackground上报，
+// 与前台调用区分，例如熔断器半开时只统计前台探测请求的结果
+type BackgroundReporter interface {
+	ReportBackground(t TransType)
+}
+
+// LatencyReporter TransCtrl的可选扩展，实现后前台调用上报结果时会附带下游耗时和本次的超时时间，
+// 后台调用仍通过Report上报
+type LatencyReporter interface {
+	ReportLatency(t TransType, delta time.Duration, timeout time.Duration)
+}
+
+// ConcurrencyLimiter 限制在途的下游调用数，Acquire失败的调用走降级逻辑，
+// 每次Acquire成功的调用在下游真正返回后（包括超时后迟到的返回）调用一次Release
+type ConcurrencyLimiter interface {
+	Acquire() bool
+	Release(t TransType, delta time.Duration)
+}
+
+// TrafficType 下游流量类型
+type TrafficType int
+
+const (
+	// TrafficForeground Call触发的前台调用
+	TrafficForeground TrafficType = iota
+	// TrafficBackground 后台更新触发的调用
+	TrafficBackground
+)
+
+func (t TrafficType) String() string {
+	if t == TrafficBackground {
+		return "Background"
+	}
+	return "Foreground"
+}
+
+// RateLimiter 下游QPS限制，前台调用被限制时走降级逻辑，后台调用被限制时跳过本批次
+type RateLimiter interface {
+	Allow(t TrafficType) bool
+}
+
 // FindInCacheCaller 提供直接方法缓存获取结果方法
 type FindInCacheCaller interface {
 	CallInCache(req Req) (rsp Rsp, err error)
 }
+
+// MetaCaller 调用时同时返回每个item的数据来源和新鲜度
+type MetaCaller interface {
+	CallWithMeta(ctx context.Context, timeout time.Duration, req Req) (rsp Rsp, meta CallMeta, err error)
+}
+
+// ItemSource item数据来源
+type ItemSource int
+
+const (
+	// ItemSourceNone 没有数据
+	ItemSourceNone ItemSource = iota
+	// ItemSourceCache 命中缓存
+	ItemSourceCache
+	// ItemSourceDownstream 来自下游，包括合并同key的在途调用
+	ItemSourceDownstream
+	// ItemSourceDegraded 降级或限流时返回的缓存数据
+	ItemSourceDegraded
+)
+
+func (s ItemSource) String() string {
+	switch s {
+	case ItemSourceCache:
+		return "Cache"
+	case ItemSourceDownstream:
+		return "Downstream"
+	case ItemSourceDegraded:
+		return "Degraded"
+	}
+	return "None"
+}
+
+// ItemMeta 单个item的元信息
+type ItemMeta struct {
+	Source ItemSource
+	// Age 缓存数据的年龄，根据Item.TS计算，来自下游或没有数据时为0
+	Age time.Duration
+	// DownstreamFailed 该item需要调用下游但下游失败或超时
+	DownstreamFailed bool
+	// Degraded 该item需要调用下游但因降级或限流没有调用，返回的是缓存中已有的数据或空数据
+	Degraded bool
+	// Absent 负缓存中确认不存在该key
+	Absent bool
+}
+
+// CallMeta 以item key为索引的元信息
+type CallMeta map[string]*ItemMeta
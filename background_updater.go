@@ -6,11 +6,22 @@ import (
 	"github.com/davidhacking/cached_caller/utils"
 )
 
+const defaultBackgroundUpdateMaxAge = 10 * time.Minute
+
 type defaultBackgroundUpdater struct {
+	maxAge time.Duration // 为0时使用defaultBackgroundUpdateMaxAge
 }
 
+// NeedUpdate item设置了SoftTTL时超过SoftTTL才更新，否则超过maxAge更新
 func (v *defaultBackgroundUpdater) NeedUpdate(item *Item) bool {
-	if utils.NowTS()-item.TS > int64((10*time.Minute)/time.Second) {
+	if item.SoftTTL > 0 {
+		return item.SoftExpired()
+	}
+	maxAge := v.maxAge
+	if maxAge <= 0 {
+		maxAge = defaultBackgroundUpdateMaxAge
+	}
+	if utils.NowTS()-item.TS > int64(maxAge/time.Second) {
 		return true
 	}
 	return false
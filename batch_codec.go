@@ -0,0 +1,131 @@
+package cached_caller
+
+import (
+	"fmt"
+
+	"github.com/davidhacking/cached_caller/errors"
+)
+
+// Record 回包中的一条记录，与请求中的key一一对应
+type Record[V any] struct {
+	Key   string
+	Value V
+	// TS 写入缓存的时间
+	TS int64
+	// Found 缓存和下游都没有数据、确认不存在或schema不匹配的缓存数据未能刷新时为false，Value为零值
+	Found bool
+}
+
+// BatchCodecConfig "请求是key列表，回包是以key为索引的记录列表"这类接口的编解码配置，
+// Q为请求类型，R为回包类型，V为记录类型
+type BatchCodecConfig[Q, R, V any] struct {
+	// RequestKeys 请求中的key列表
+	RequestKeys func(req Q) []string
+	// BuildRequest 根据key列表构造请求，origin为用户的原请求，用于复制userInfo等与key无关的字段，
+	// 后台更新没有原请求，origin为Q的零值
+	BuildRequest func(origin Q, keys []string) Q
+	// SplitResponse 回包拆分为以key为索引的记录
+	SplitResponse func(rsp R) map[string]V
+	// AssembleResponse 根据记录构造回包，records按请求中key的顺序排列
+	AssembleResponse func(records []Record[V]) R
+	// Marshaller 记录的序列化方式，为nil时使用JSONMarshaller
+	Marshaller ValueMarshaller
+}
+
+// BatchCodec 根据BatchCodecConfig生成的请求和回包编解码
+type BatchCodec[Q, R, V any] struct {
+	config BatchCodecConfig[Q, R, V]
+}
+
+// NewBatchCodec 创建BatchCodec，通过ReqCodec、RspCodec获取编解码器
+func NewBatchCodec[Q, R, V any](config BatchCodecConfig[Q, R, V]) (*BatchCodec[Q, R, V], error) {
+	if config.RequestKeys == nil || config.BuildRequest == nil ||
+		config.SplitResponse == nil || config.AssembleResponse == nil {
+		return nil, fmt.Errorf("RequestKeys, BuildRequest, SplitResponse and AssembleResponse must not be nil")
+	}
+	if config.Marshaller == nil {
+		config.Marshaller = JSONMarshaller{}
+	}
+	return &BatchCodec[Q, R, V]{config: config}, nil
+}
+
+// ReqCodec 请求编解码，实现了TypedMissReqBuilder，只用未命中的key构造请求时保留原请求中与key无关的字段
+func (b *BatchCodec[Q, R, V]) ReqCodec() TypedReqCodec[Q] {
+	return &batchReqCodec[Q, R, V]{config: &b.config}
+}
+
+// RspCodec 回包编解码
+func (b *BatchCodec[Q, R, V]) RspCodec() TypedRspCodec[R] {
+	return &batchRspCodec[Q, R, V]{config: &b.config}
+}
+
+type batchReqCodec[Q, R, V any] struct {
+	config *BatchCodecConfig[Q, R, V]
+}
+
+func (c *batchReqCodec[Q, R, V]) Encode(req Q) ([]*Item, error) {
+	keys := c.config.RequestKeys(req)
+	items := make([]*Item, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, &Item{Key: key})
+	}
+	return items, nil
+}
+
+func (c *batchReqCodec[Q, R, V]) Decode(items []*Item) (Q, error) {
+	var zero Q
+	return c.config.BuildRequest(zero, itemKeys(items)), nil
+}
+
+func (c *batchReqCodec[Q, R, V]) BuildMissReq(req Q, items []*Item) (Q, error) {
+	return c.config.BuildRequest(req, itemKeys(items)), nil
+}
+
+type batchRspCodec[Q, R, V any] struct {
+	config *BatchCodecConfig[Q, R, V]
+}
+
+func (c *batchRspCodec[Q, R, V]) Encode(rsp R) ([]*Item, error) {
+	records := c.config.SplitResponse(rsp)
+	items := make([]*Item, 0, len(records))
+	for key, value := range records {
+		data, err := c.config.Marshaller.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("marshal record key=%v failed, err=%v", key, err)
+		}
+		items = append(items, &Item{Key: key, Data: data})
+	}
+	return items, nil
+}
+
+// CheckItem Marshaller带schema时，schema不匹配的缓存数据按未命中处理
+func (c *batchRspCodec[Q, R, V]) CheckItem(item *Item) error {
+	checker, ok := c.config.Marshaller.(schemaChecker)
+	if !ok {
+		return nil
+	}
+	var value V
+	return checker.checkSchema(item.Data, &value)
+}
+
+func (c *batchRspCodec[Q, R, V]) Decode(items []*Item) (R, error) {
+	records := make([]Record[V], 0, len(items))
+	for _, item := range items {
+		record := Record[V]{Key: item.Key, TS: item.TS}
+		if !item.Empty() {
+			err := c.config.Marshaller.Unmarshal(item.Data, &record.Value)
+			// 未经CheckItem过滤的schema不匹配数据按没有数据处理
+			if errors.Is(err, errors.ErrSchemaMismatch) {
+				records = append(records, record)
+				continue
+			}
+			if err != nil {
+				var zero R
+				return zero, fmt.Errorf("unmarshal record key=%v failed, err=%v", item.Key, err)
+			}
+			record.Found = true
+		}
+		records = append(records, record)
+	}
+	return c.config.AssembleResponse(records), nil
+}
@@ -0,0 +1,98 @@
+package cached_caller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordFeatureCaller struct {
+	client *FeatureCenterServer
+	reqs   []*FeatureRequest
+}
+
+func (v *recordFeatureCaller) Call(ctx context.Context, timeout time.Duration, req *FeatureRequest) (*FeatureResponse, error) {
+	v.reqs = append(v.reqs, req)
+	return v.client.GetFeature(req)
+}
+
+func newFeatureBatchCodec(t *testing.T, marshaller ValueMarshaller) *BatchCodec[*FeatureRequest, *FeatureResponse, *ItemInfo] {
+	codec, err := NewBatchCodec(BatchCodecConfig[*FeatureRequest, *FeatureResponse, *ItemInfo]{
+		RequestKeys: func(req *FeatureRequest) []string {
+			keys := make([]string, 0, len(req.itemInfos))
+			for _, info := range req.itemInfos {
+				keys = append(keys, info.ItemID)
+			}
+			return keys
+		},
+		BuildRequest: func(origin *FeatureRequest, keys []string) *FeatureRequest {
+			req := &FeatureRequest{}
+			if origin != nil {
+				req.userInfo = origin.userInfo
+			}
+			for _, key := range keys {
+				req.itemInfos = append(req.itemInfos, &ItemInfo{ItemID: key})
+			}
+			return req
+		},
+		SplitResponse: func(rsp *FeatureResponse) map[string]*ItemInfo {
+			records := make(map[string]*ItemInfo, len(rsp.itemInfos))
+			for _, info := range rsp.itemInfos {
+				records[info.ItemID] = info
+			}
+			return records
+		},
+		AssembleResponse: func(records []Record[*ItemInfo]) *FeatureResponse {
+			rsp := &FeatureResponse{}
+			for _, record := range records {
+				info := &ItemInfo{ItemID: record.Key, TS: record.TS}
+				if record.Found {
+					info.Feature = record.Value.Feature
+				}
+				rsp.itemInfos = append(rsp.itemInfos, info)
+			}
+			return rsp
+		},
+		Marshaller: marshaller,
+	})
+	assert.Nil(t, err)
+	return codec
+}
+
+func TestBatchCodec(t *testing.T) {
+	for _, marshaller := range []ValueMarshaller{nil, GobMarshaller{}} {
+		codec := newFeatureBatchCodec(t, marshaller)
+		caller := &recordFeatureCaller{}
+		c, err := NewTypedCachedCaller[*FeatureRequest, *FeatureResponse](caller, codec.ReqCodec(), codec.RspCodec(),
+			WithCache(newTestCaching()),
+		)
+		assert.Nil(t, err)
+		user := &Feature{IntVal: 7}
+		_, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+			userInfo: user, itemInfos: []*ItemInfo{{ItemID: "111"}}})
+		assert.Nil(t, err)
+		rsp, err := c.Call(context.Background(), time.Second, &FeatureRequest{
+			userInfo: user, itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}}})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(rsp.itemInfos))
+		assert.Equal(t, "111", rsp.itemInfos[0].ItemID)
+		assert.Equal(t, fid1Value, rsp.itemInfos[0].Feature[fid1].IntVal)
+		assert.Equal(t, fid1Value, rsp.itemInfos[1].Feature[fid1].IntVal)
+
+		// 只用未命中的key调用下游，保留原请求的userInfo
+		assert.Equal(t, 2, len(caller.reqs))
+		assert.Equal(t, 1, len(caller.reqs[1].itemInfos))
+		assert.Equal(t, "222", caller.reqs[1].itemInfos[0].ItemID)
+		assert.Equal(t, user, caller.reqs[1].userInfo)
+
+		rsp, err = c.CallInCache(&FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "333"}}})
+		assert.Nil(t, err)
+		assert.Nil(t, rsp.itemInfos[0].Feature)
+		assert.Nil(t, c.Close(context.Background()))
+	}
+
+	_, err := NewBatchCodec(BatchCodecConfig[*FeatureRequest, *FeatureResponse, *ItemInfo]{})
+	assert.NotNil(t, err)
+}
@@ -1,9 +1,11 @@
 package cached_caller
 
 import (
+	"io"
 	"time"
 
 	"github.com/allegro/bigcache/v3"
+	"github.com/davidhacking/cached_caller/errors"
 )
 
 type bigCacheDecorator struct {
@@ -19,14 +21,22 @@ func NewBigCaching(config ...bigcache.Config) Caching {
 	if len(config) > 0 {
 		c = config[0]
 	}
-	cache, err := bigcache.NewBigCache(c)
+	res, err := newBigCaching(c)
 	if err != nil {
 		panic(err)
 	}
+	return res
+}
+
+func newBigCaching(c bigcache.Config) (Caching, error) {
+	cache, err := bigcache.NewBigCache(c)
+	if err != nil {
+		return nil, err
+	}
 	res := &bigCacheDecorator{
 		cache: cache,
 	}
-	return res
+	return res, nil
 }
 
 func (b *bigCacheDecorator) Get(key string) (value []byte, err error) {
@@ -41,6 +51,26 @@ func (b *bigCacheDecorator) Del(key string) error {
 	return b.cache.Delete(key)
 }
 
+func (b *bigCacheDecorator) Close() error {
+	return b.cache.Close()
+}
+
 func (b *bigCacheDecorator) GetIter() CacheIter {
 	return &bigcacheIter{iter: b.cache.Iterator()}
 }
+
+func (b *bigCacheDecorator) Dump(writer io.Writer) error {
+	_, err := writeDump(writer, b.GetIter())
+	return err
+}
+
+func (b *bigCacheDecorator) FromDump(reader io.Reader) error {
+	stats, err := readDump(reader, b.Put)
+	if err != nil {
+		return err
+	}
+	if stats.corrupt > 0 {
+		return errors.ErrDumpCorrupt
+	}
+	return nil
+}
@@ -3,6 +3,12 @@ package cached_caller
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/davidhacking/cached_caller/errors"
@@ -10,50 +16,193 @@ import (
 )
 
 type cachedCallerImpl struct {
-	caller Caller
-	config *Config
+	caller          Caller
+	config          atomic.Value
+	reconfigureLock sync.Mutex
+	reloaded        chan struct{}
+	inflight        *inflightGroup
+	revalidator     *revalidator
+	swrWorkers      int32
+	done            chan struct{}
+	closeOnce       sync.Once
+	bgLock          sync.Mutex
+	closed          bool
+	released        chan struct{}
+	closeErr        error
+	wg              sync.WaitGroup
 }
 
-func (c *cachedCallerImpl) realCall(ctx context.Context, timeout time.Duration,
-	req Req) (rsp Rsp, delta time.Duration, err error) {
+type callResult struct {
+	rsp Rsp
+	err error
+}
+
+// realCall 带超时调用下游，超时或ctx取消时立即返回，下游的迟到结果交给onLate处理；
+// 被限流时不调用下游，返回ErrRateLimit或ErrConcurrencyLimit
+func (c *cachedCallerImpl) realCall(ctx context.Context, traffic TrafficType, timeout time.Duration,
+	req Req, onLate func(rsp Rsp, err error)) (rsp Rsp, delta time.Duration, err error) {
+	rateLimiter := c.cfg().rateLimiter
+	if rateLimiter != nil && !rateLimiter.Allow(traffic) {
+		c.cfg().monitor.Inc("rateLimitReject" + traffic.String())
+		return nil, 0, errors.ErrRateLimit
+	}
+	limiter := c.cfg().concurrencyLimiter
+	if limiter != nil && !limiter.Acquire() {
+		c.cfg().monitor.Inc("concurrencyReject")
+		return nil, 0, errors.ErrConcurrencyLimit
+	}
 	start := time.Now()
-	rsp, err = c.caller.Call(ctx, timeout, req)
-	delta = time.Since(start)
-	return rsp, delta, err
+	callCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		callCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	resultCh := make(chan callResult, 1)
+	go func() {
+		defer cancel()
+		rsp, err := c.caller.Call(callCtx, timeout, req)
+		if limiter != nil {
+			delta := time.Since(start)
+			t := transTypeOf(delta, timeout, err)
+			if isCanceled(ctx, err) {
+				t = TransTypeCanceled
+			}
+			limiter.Release(t, delta)
+		}
+		resultCh <- callResult{rsp: rsp, err: err}
+	}()
+	select {
+	case res := <-resultCh:
+		return res.rsp, time.Since(start), res.err
+	case <-callCtx.Done():
+		// 迟到结果的处理受Close管理，Close后不再处理，避免在最后一次dump和关闭缓存后写缓存
+		if onLate != nil && !c.goBackground(func() {
+			res := <-resultCh
+			onLate(res.rsp, res.err)
+		}) {
+			c.cfg().monitor.Inc("lateRspDropped")
+		}
+		delta = time.Since(start)
+		if callCtx.Err() == context.DeadlineExceeded {
+			return nil, delta, errors.ErrCallTimeout
+		}
+		return nil, delta, callCtx.Err()
+	}
+}
+
+// cacheLateRsp 超时后下游返回的结果仍用于刷新缓存，调用期间已被其他调用更新过的key不再覆盖
+func (c *cachedCallerImpl) cacheLateRsp(missItems []*Item) func(rsp Rsp, err error) {
+	mon := c.cfg().monitor
+	log := c.cfg().logger
+	lateItems := make([]*Item, len(missItems))
+	copy(lateItems, missItems)
+	baseTS := make(map[string]int64, len(missItems))
+	for _, item := range missItems {
+		baseTS[item.Key] = item.TS
+	}
+	return func(rsp Rsp, err error) {
+		if err != nil {
+			mon.Inc("lateCallFail")
+			return
+		}
+		err = c.rsp2Items(rsp, lateItems)
+		if err != nil {
+			mon.Inc("lateRsp2ItemsFail")
+			log.Errorf("rsp2Items late rsp failed, err=%v", err)
+			return
+		}
+		items := make([]*Item, 0, len(lateItems))
+		for _, item := range lateItems {
+			if c.cachedTS(item.Key) > baseTS[item.Key] {
+				continue
+			}
+			items = append(items, item)
+		}
+		mon.Inc("lateRspOutdated", len(lateItems)-len(items))
+		err = c.setItemsToCache(items)
+		if err != nil {
+			mon.Inc("lateSetCacheFail")
+			log.Errorf("setItemsToCache late rsp failed, err=%v", err)
+			return
+		}
+		mon.Inc("lateRspCached", len(items))
+	}
+}
+
+// cachedTS 缓存中key当前的TS，不存在或无法解码时返回0
+func (c *cachedCallerImpl) cachedTS(key string) int64 {
+	cache := c.cfg().cache
+	if cache == nil {
+		return 0
+	}
+	itemCodec := c.cfg().itemCodec
+	cacheKey, _, err := itemCodec.Encode(&Item{Key: key})
+	if err != nil {
+		return 0
+	}
+	value, err := cache.Get(cacheKey)
+	if err != nil {
+		return 0
+	}
+	item, err := itemCodec.Decode(cacheKey, value)
+	if err != nil {
+		return 0
+	}
+	return item.TS
 }
 
 func (c *cachedCallerImpl) Call(ctx context.Context, timeout time.Duration, req Req) (rsp Rsp, err error) {
-	cache := c.config.cache
-	ctrl := c.config.transCtrl
-	mon := c.config.monitor
-	reqCodec := c.config.reqCodec
+	return c.call(ctx, timeout, req, nil)
+}
+
+func (c *cachedCallerImpl) CallWithMeta(ctx context.Context, timeout time.Duration, req Req) (
+	rsp Rsp, meta CallMeta, err error) {
+	meta = make(CallMeta)
+	rsp, err = c.call(ctx, timeout, req, meta)
+	return rsp, meta, err
+}
+
+// call meta不为nil时记录每个item的元信息
+func (c *cachedCallerImpl) call(ctx context.Context, timeout time.Duration, req Req, meta CallMeta) (
+	rsp Rsp, err error) {
+	ctrl := c.cfg().transCtrl
+	mon := c.cfg().monitor
+	reqCodec := c.cfg().reqCodec
+	start := time.Now()
 	mon.Inc("Enter")
 	items, err := reqCodec.Encode(req)
 	if err != nil {
 		mon.Inc("EncodeFail")
-		return nil, fmt.Errorf("reqCodec Encode failed, err=%v", err)
+		return nil, errors.Wrap(errors.ErrEncode, "reqCodec Encode", err)
 	}
 	mon.Inc("cachedCallerEnterItems", len(items))
 	if len(items) <= 0 {
 		mon.Inc("EncodeNil")
-		return nil, fmt.Errorf("reqCodec Encode return items is nil")
+		return nil, errors.Wrap(errors.ErrEncode, "reqCodec Encode", fmt.Errorf("return items is nil"))
 	}
 	err = c.findItemByCache(items)
 	if err != nil {
 		mon.Inc("FindInCacheFail")
-		return nil, fmt.Errorf("findItemByCache failed, err=%v", err)
+		return nil, err
 	}
-	if ctrl.Degrade() {
-		mon.Inc("DegradeEnter")
-		if cache == nil {
-			mon.Inc("DegradeNoCache")
-			return nil, fmt.Errorf("caller degrade with no cache return")
-		}
-		err = c.setItemsToCache(items, true)
-		if err != nil {
-			mon.Inc("setCacheFail")
-			return nil, fmt.Errorf("setItemsToCache failed, err=%v", err)
+	metas := newItemMetas(items, meta)
+	defer metas.fill(items, meta)
+	maxStale := c.cfg().staleWhileRevalidate
+	c.revalidate(items, maxStale)
+	missIdx := missItemIndexes(items, maxStale)
+	mon.Inc("cacheHitItems", len(items)-len(missIdx))
+	mon.Inc("cacheMissItems", len(missIdx))
+	negativeHit, softExpired := 0, 0
+	for _, item := range items {
+		if item.Absent {
+			negativeHit++
+		} else if !item.Empty() && item.SoftExpired() {
+			softExpired++
 		}
+	}
+	mon.Inc("negativeHitItems", negativeHit)
+	mon.Inc("softExpiredItems", softExpired)
+	if len(missIdx) <= 0 {
+		mon.Inc("AllHit")
 		rsp, err = c.items2Rsp(items)
 		if err != nil {
 			mon.Inc("items2RspFail")
@@ -61,48 +210,339 @@ func (c *cachedCallerImpl) Call(ctx context.Context, timeout time.Duration, req
 		}
 		return rsp, nil
 	}
-	var delta time.Duration
-	rsp, delta, err = c.realCall(ctx, timeout, req)
-	c.reportTransCtrl(delta, timeout, err)
+	if ctrl.Degrade() {
+		mon.Inc("DegradeEnter")
+		metas.degrade(missIdx)
+		return c.degradeCall(items, fmt.Errorf("trans ctrl degrade"))
+	}
+	ownIdx, waits := c.inflight.claim(items, missIdx)
+	mon.Inc("dedupHitItems", len(waits))
+	if len(ownIdx) > 0 {
+		rsp, err = c.callOwnItems(ctx, timeout, req, items, ownIdx)
+		if isLimited(err) {
+			mon.Inc("limitDegrade")
+			metas.degrade(missIdx)
+			return c.degradeCall(items, err)
+		}
+		if err != nil {
+			metas.downstreamFailed(missIdx)
+			return c.failedCall(items, err)
+		}
+		metas.fromDownstream(items, ownIdx)
+	}
+	err = c.waitInflight(ctx, start, timeout, items, waits)
+	metas.fromInflight(items, waits)
+	if err == context.Canceled {
+		return c.failedCall(items, errors.Wrap(context.Canceled, "inflight call", err))
+	}
+	if err != nil {
+		return c.failedCall(items, errors.Wrap(errors.ErrCallTimeout, "inflight call", err))
+	}
+	if n := failedWaits(waits); n > 0 {
+		mon.Inc("dedupWaitFail", n)
+		return c.failedCall(items, errors.Wrap(errors.ErrDownstream, "inflight call",
+			fmt.Errorf("%v items not returned", n)))
+	}
+	if len(ownIdx) == len(items) {
+		return rsp, nil
+	}
+	if !anyResolved(items) {
+		mon.Inc("dedupAllFail")
+		return nil, errors.Wrap(errors.ErrDownstream, "inflight call", fmt.Errorf("no item returned"))
+	}
+	mon.Inc("mergedItems", len(missIdx))
+	rsp, err = c.items2Rsp(items)
+	if err != nil {
+		mon.Inc("items2RspFail")
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// failedCall 下游调用失败时对已命中的缓存保活，有缓存数据时连同ErrPartialResult一起返回
+func (c *cachedCallerImpl) failedCall(items []*Item, callErr error) (rsp Rsp, err error) {
+	mon := c.cfg().monitor
+	hitItems := cachedItems(items)
+	err = c.setItemsToCache(hitItems)
+	if err != nil {
+		mon.Inc("setCacheFail")
+		return nil, err
+	}
+	if len(hitItems) <= 0 {
+		return nil, callErr
+	}
+	if errors.Is(callErr, errors.ErrCallTimeout) {
+		mon.Inc("staleOnTimeout")
+	}
+	mon.Inc("partialResult")
+	rsp, err = c.items2Rsp(items)
+	if err != nil {
+		mon.Inc("items2RspFail")
+		return nil, err
+	}
+	return rsp, errors.Wrap(errors.ErrPartialResult, "Call", callErr)
+}
+
+// callOwnItems 调用下游获取本次认领的item并合并回items，结束时通知等待同key的调用
+func (c *cachedCallerImpl) callOwnItems(ctx context.Context, timeout time.Duration, req Req,
+	items []*Item, ownIdx []int) (rsp Rsp, err error) {
+	mon := c.cfg().monitor
+	missReq, missItems := c.buildMissReq(req, items, ownIdx)
+	keys := itemKeys(missItems)
+	var results []*Item
+	defer func() {
+		c.inflight.release(keys, results)
+	}()
+	rsp, delta, err := c.realCall(ctx, TrafficForeground, timeout, missReq, c.cacheLateRsp(missItems))
+	if isLimited(err) {
+		return nil, err
+	}
+	if isCanceled(ctx, err) {
+		mon.Inc("realCallCanceled")
+		return nil, errors.Wrap(context.Canceled, "realCall", err)
+	}
+	c.reportTransCtrl(TrafficForeground, delta, timeout, err)
 	if err != nil {
 		mon.Inc("realCallFail")
-		setCacheErr := c.setItemsToCache(items)
-		if setCacheErr != nil {
-			mon.Inc("setCacheFail")
-			return nil, fmt.Errorf("setItemsToCache failed, err=%v", setCacheErr)
+		if isTimeout(ctx, err) {
+			return nil, errors.Wrap(errors.ErrCallTimeout, "realCall", err)
 		}
-		return nil, fmt.Errorf("realCall failed, err=%v", err)
+		return nil, errors.Wrap(errors.ErrDownstream, "realCall", err)
 	}
-	err = c.rsp2Items(rsp, items)
+	err = c.rsp2Items(rsp, missItems)
 	if err != nil {
-		setCacheErr := c.setItemsToCache(items)
-		if setCacheErr != nil {
-			mon.Inc("setCacheFail")
-			return nil, fmt.Errorf("setItemsToCache failed, err=%v", setCacheErr)
+		return nil, err
+	}
+	for i, idx := range ownIdx {
+		items[idx] = missItems[i]
+	}
+	err = c.setItemsToCache(missItems)
+	if err != nil {
+		mon.Inc("setCacheFail")
+		return nil, err
+	}
+	results = missItems
+	return rsp, nil
+}
+
+// waitInflight 等待其他调用正在获取的item，最多等到本次调用超时，超时或ctx结束时返回错误
+func (c *cachedCallerImpl) waitInflight(ctx context.Context, start time.Time, timeout time.Duration,
+	items []*Item, waits map[int]*flight) error {
+	mon := c.cfg().monitor
+	if len(waits) <= 0 {
+		return nil
+	}
+	waitStart := time.Now()
+	defer func() {
+		mon.Inc("dedupWaitMs", int(time.Since(waitStart)/time.Millisecond))
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout - time.Since(start))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for idx, f := range waits {
+		select {
+		case <-f.done:
+			if f.item != nil {
+				items[idx] = f.item
+			}
+		case <-expired:
+			mon.Inc("dedupWaitTimeout")
+			collectInflight(items, waits)
+			return errors.ErrCallTimeout
+		case <-ctx.Done():
+			mon.Inc("dedupWaitTimeout")
+			collectInflight(items, waits)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// collectInflight 等待超时后不再阻塞，合并已经完成的在途调用的item
+func collectInflight(items []*Item, waits map[int]*flight) {
+	for idx, f := range waits {
+		select {
+		case <-f.done:
+			if f.item != nil {
+				items[idx] = f.item
+			}
+		default:
+		}
+	}
+}
+
+// failedWaits 在途调用失败、被限流或超时而没有返回数据的等待数
+func failedWaits(waits map[int]*flight) int {
+	n := 0
+	for _, f := range waits {
+		if f.item == nil {
+			n++
 		}
-		return nil, fmt.Errorf("rsp2Items failed, err=%v", err)
 	}
-	err = c.setItemsToCache(items)
+	return n
+}
+
+// cachedItems 返回有数据的item
+func cachedItems(items []*Item) []*Item {
+	res := make([]*Item, 0, len(items))
+	for _, item := range items {
+		if !item.Empty() {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// degradeCall 降级时不调用下游，只返回缓存中已有的数据，cause为降级原因，
+// 降级的item可通过CallWithMeta的ItemMeta.Degraded区分
+func (c *cachedCallerImpl) degradeCall(items []*Item, cause error) (rsp Rsp, err error) {
+	mon := c.cfg().monitor
+	if c.cfg().cache == nil {
+		mon.Inc("DegradeNoCache")
+		return nil, errors.Wrap(errors.ErrDegraded, "Call", cause)
+	}
+	err = c.setItemsToCache(items, true)
 	if err != nil {
 		mon.Inc("setCacheFail")
-		return nil, fmt.Errorf("setItemsToCache failed, err=%v", err)
+		return nil, err
+	}
+	rsp, err = c.items2Rsp(items)
+	if err != nil {
+		mon.Inc("items2RspFail")
+		return nil, err
 	}
 	return rsp, nil
 }
 
+// withinStale 超过SoftTTL但未超过SoftTTL+maxStale，可以先返回再异步刷新
+func withinStale(item *Item, maxStale time.Duration) bool {
+	return maxStale > 0 && item.Age() < item.SoftTTL+maxStale
+}
+
+// revalidate 超过SoftTTL但仍可返回的item加入异步刷新队列
+func (c *cachedCallerImpl) revalidate(items []*Item, maxStale time.Duration) {
+	if maxStale <= 0 || c.cfg().cache == nil {
+		return
+	}
+	mon := c.cfg().monitor
+	for _, item := range items {
+		if item.Empty() || !item.SoftExpired() || !withinStale(item, maxStale) {
+			continue
+		}
+		mon.Inc("swrServedItems")
+		ok, full := c.revalidator.enqueue(item)
+		if ok {
+			mon.Inc("swrEnqueued")
+			c.startRevalidateWorker()
+		}
+		if full {
+			mon.Inc("swrQueueFull")
+		}
+	}
+}
+
+// startRevalidateWorker 有item入队时按需启动刷新协程，协程数不超过backgroundUpdateParallelNum
+func (c *cachedCallerImpl) startRevalidateWorker() {
+	n := atomic.LoadInt32(&c.swrWorkers)
+	if int(n) >= c.cfg().backgroundUpdateParallelNum || !atomic.CompareAndSwapInt32(&c.swrWorkers, n, n+1) {
+		return
+	}
+	if !c.goBackground(c.revalidateLoop) {
+		atomic.AddInt32(&c.swrWorkers, -1)
+	}
+}
+
+// revalidateLoop 从刷新队列中按backgroundUpdateBatchNum取出item，通过updateCache刷新，
+// TransCtrl实现了DegradeChecker且正在降级时丢弃本批次，Reconfigure调小backgroundUpdateParallelNum后多余的协程退出
+func (c *cachedCallerImpl) revalidateLoop() {
+	for {
+		n := atomic.LoadInt32(&c.swrWorkers)
+		if int(n) > c.cfg().backgroundUpdateParallelNum && atomic.CompareAndSwapInt32(&c.swrWorkers, n, n-1) {
+			return
+		}
+		batch := c.revalidator.next(c.cfg().backgroundUpdateBatchNum, c.done)
+		if batch == nil {
+			atomic.AddInt32(&c.swrWorkers, -1)
+			return
+		}
+		if c.degrading() {
+			c.cfg().monitor.Inc("swrDegradeDropped", len(batch))
+		} else {
+			c.updateCache(batch)
+		}
+		c.revalidator.finish(batch)
+	}
+}
+
+// degrading 后台调用前检查是否在降级，不消耗前台的降级名额
+func (c *cachedCallerImpl) degrading() bool {
+	checker, ok := c.cfg().transCtrl.(DegradeChecker)
+	return ok && checker.Degrading()
+}
+
+// anyResolved 是否有item有数据或确认不存在
+func anyResolved(items []*Item) bool {
+	for _, item := range items {
+		if item.Resolved() {
+			return true
+		}
+	}
+	return false
+}
+
+// missItemIndexes 返回需要调用下游的item下标：缓存未命中且未确认不存在，或超过SoftTTL+maxStale
+func missItemIndexes(items []*Item, maxStale time.Duration) []int {
+	missIdx := make([]int, 0, len(items))
+	for i, item := range items {
+		if !item.Resolved() || (item.SoftExpired() && !withinStale(item, maxStale)) {
+			missIdx = append(missIdx, i)
+		}
+	}
+	return missIdx
+}
+
+// buildMissReq 只用未命中的item重新构造请求，全部未命中时直接使用原请求
+func (c *cachedCallerImpl) buildMissReq(req Req, items []*Item, missIdx []int) (Req, []*Item) {
+	mon := c.cfg().monitor
+	log := c.cfg().logger
+	if len(missIdx) == len(items) {
+		return req, items
+	}
+	missItems := make([]*Item, 0, len(missIdx))
+	for _, idx := range missIdx {
+		missItems = append(missItems, items[idx])
+	}
+	var missReq Req
+	var err error
+	if builder, ok := c.cfg().reqCodec.(MissReqBuilder); ok {
+		missReq, err = builder.BuildMissReq(req, missItems)
+	} else {
+		missReq, err = c.cfg().reqCodec.Decode(missItems)
+	}
+	if err != nil {
+		mon.Inc("missReqDecodeFail")
+		log.Errorf("reqCodec Decode miss items failed, fallback to origin req, err=%v", err)
+		return req, missItems
+	}
+	return missReq, missItems
+}
+
 func (c *cachedCallerImpl) CallInCache(req Req) (rsp Rsp, err error) {
-	mon := c.config.monitor
-	reqCodec := c.config.reqCodec
+	mon := c.cfg().monitor
+	reqCodec := c.cfg().reqCodec
 	mon.Inc("CallInCacheEnter")
 	items, err := reqCodec.Encode(req)
 	if err != nil {
 		mon.Inc("EncodeFail")
-		return nil, fmt.Errorf("reqCodec Encode failed, err=%v", err)
+		return nil, errors.Wrap(errors.ErrEncode, "reqCodec Encode", err)
 	}
 	err = c.findItemByCache(items)
 	if err != nil {
 		mon.Inc("FindInCacheFail")
-		return nil, fmt.Errorf("findItemByCache failed, err=%v", err)
+		return nil, err
 	}
 	rsp, err = c.items2Rsp(items)
 	if err != nil {
@@ -113,11 +553,11 @@ func (c *cachedCallerImpl) CallInCache(req Req) (rsp Rsp, err error) {
 }
 
 func (c *cachedCallerImpl) rsp2Items(rsp Rsp, items []*Item) error {
-	rspCodec := c.config.rspCodec
-	mon := c.config.monitor
+	rspCodec := c.cfg().rspCodec
+	mon := c.cfg().monitor
 	newItems, err := rspCodec.Encode(rsp)
 	if err != nil {
-		return fmt.Errorf("rspCodec Encode failed, err=%v", err)
+		return errors.Wrap(errors.ErrEncode, "rspCodec Encode", err)
 	}
 	m := make(map[string]*Item, len(newItems))
 	invalid := 0
@@ -130,10 +570,14 @@ func (c *cachedCallerImpl) rsp2Items(rsp Rsp, items []*Item) error {
 	}
 	mon.Inc("rsp2ItemsInvalidKey", invalid)
 	invalidResp := 0
+	negativeTTL := c.cfg().negativeCacheTTL
 	for i, item := range items {
 		newItem, ok := m[item.Key]
 		if !ok {
 			invalidResp++
+			if negativeTTL > 0 {
+				items[i] = &Item{Key: item.Key, Absent: true}
+			}
 			continue
 		}
 		items[i] = newItem
@@ -142,73 +586,145 @@ func (c *cachedCallerImpl) rsp2Items(rsp Rsp, items []*Item) error {
 	return nil
 }
 
-func (c *cachedCallerImpl) reportTransCtrl(delta time.Duration, timeout time.Duration, err error) {
-	ctrl := c.config.transCtrl
-	mon := c.config.monitor
-	if delta > timeout {
-		mon.Inc("recallCallTimeout")
-		ctrl.Report(TransTypeTimeout)
-		return
+// isLimited 调用被限流，下游没有真正被调用
+func isLimited(err error) bool {
+	return err == errors.ErrRateLimit || err == errors.ErrConcurrencyLimit
+}
+
+// isTimeout 下游调用因超时或ctx到期而未返回
+func isTimeout(ctx context.Context, err error) bool {
+	return err == errors.ErrCallTimeout || (ctx.Err() == context.DeadlineExceeded && err == ctx.Err())
+}
+
+// isCanceled 调用方取消了ctx，下游的失败不计入拥塞控制
+func isCanceled(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == context.Canceled
+}
+
+// transTypeOf timeout<=0时不限时，只按err判断
+func transTypeOf(delta time.Duration, timeout time.Duration, err error) TransType {
+	if err == errors.ErrCallTimeout || (timeout > 0 && delta > timeout) {
+		return TransTypeTimeout
 	}
 	if err != nil {
+		return TransTypeFail
+	}
+	return TransTypeSuccess
+}
+
+// reportTransCtrl 后台调用的批次大小和超时与前台不同，不上报耗时，避免影响前台的降级
+func (c *cachedCallerImpl) reportTransCtrl(traffic TrafficType, delta time.Duration, timeout time.Duration,
+	err error) {
+	ctrl := c.cfg().transCtrl
+	mon := c.cfg().monitor
+	t := transTypeOf(delta, timeout, err)
+	switch t {
+	case TransTypeTimeout:
+		mon.Inc("recallCallTimeout")
+	case TransTypeFail:
 		mon.Inc("recallCallFail")
-		ctrl.Report(TransTypeFail)
+	}
+	if reporter, ok := ctrl.(LatencyReporter); ok && traffic == TrafficForeground {
+		reporter.ReportLatency(t, delta, timeout)
 		return
 	}
-	ctrl.Report(TransTypeSuccess)
+	if reporter, ok := ctrl.(BackgroundReporter); ok && traffic == TrafficBackground {
+		reporter.ReportBackground(t)
+		return
+	}
+	ctrl.Report(t)
 }
 
 func (c *cachedCallerImpl) items2Rsp(items []*Item) (rsp Rsp, err error) {
-	rspCodec := c.config.rspCodec
-	return rspCodec.Decode(items)
+	rspCodec := c.cfg().rspCodec
+	rsp, err = rspCodec.Decode(items)
+	if err != nil {
+		return nil, errors.Wrap(errors.ErrEncode, "rspCodec Decode", err)
+	}
+	return rsp, nil
 }
 
 // findItemByCache cache 中的item会填充到items中
 func (c *cachedCallerImpl) findItemByCache(items []*Item) error {
-	cache := c.config.cache
+	cache := c.cfg().cache
 	if cache == nil {
 		return nil
 	}
-	itemCodec := c.config.itemCodec
+	itemCodec := c.cfg().itemCodec
 	for i, item := range items {
 		if !item.Empty() {
 			continue
 		}
 		key, _, err := itemCodec.Encode(item)
 		if err != nil {
-			return fmt.Errorf("itemCodec Encode failed, err=%v", err)
+			return errors.Wrap(errors.ErrEncode, "itemCodec Encode", err)
 		}
 		value, err := cache.Get(key)
 		if err != nil {
 			continue
 		}
 		item, err = itemCodec.Decode(key, value)
+		if isBadItem(err) {
+			c.cfg().monitor.Inc("badCacheItems")
+			_ = cache.Del(key)
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("itemCodec Decode failed, err=%v", err)
+			return errors.Wrap(errors.ErrEncode, "itemCodec Decode", err)
+		}
+		if item.Absent && !c.negativeAlive(item) {
+			continue
+		}
+		if item.HardExpired() {
+			c.cfg().monitor.Inc("hardExpiredItems")
+			_ = cache.Del(key)
+			continue
+		}
+		if checker, ok := c.cfg().rspCodec.(ItemChecker); ok && !item.Empty() && checker.CheckItem(item) != nil {
+			c.cfg().monitor.Inc("invalidCacheItems")
+			continue
 		}
 		items[i] = item
 	}
 	return nil
 }
 
+// isBadItem 缓存中的item格式错误或校验失败，按未命中处理并删除，由下游数据覆盖
+func isBadItem(err error) bool {
+	return errors.Is(err, errors.ErrItemFormat) || errors.Is(err, errors.ErrItemCorrupt)
+}
+
+// negativeAlive 负缓存是否仍然有效，关闭负缓存时忽略缓存中的不存在标记
+func (c *cachedCallerImpl) negativeAlive(item *Item) bool {
+	ttl := c.cfg().negativeCacheTTL
+	if ttl <= 0 {
+		return false
+	}
+	return time.Duration(utils.NowTS()-item.TS)*time.Second < ttl
+}
+
 func (c *cachedCallerImpl) setItemsToCache(items []*Item, forceUpdateTs ...bool) error {
-	cache := c.config.cache
-	itemCodec := c.config.itemCodec
+	cache := c.cfg().cache
+	itemCodec := c.cfg().itemCodec
+	if cache == nil {
+		return nil
+	}
 	flag := false
 	if len(forceUpdateTs) > 0 {
 		flag = true
 	}
 	for _, item := range items {
-		if item.TS <= 0 || flag {
+		// 设置了TTL的item和负缓存保活时不更新TS，避免过期数据被当作新数据返回
+		if item.TS <= 0 || (flag && item.SoftTTL <= 0 && item.HardTTL <= 0 && !item.Absent) {
 			item.TS = utils.NowTS()
 		}
 		key, value, err := itemCodec.Encode(item)
 		if err != nil {
-			return fmt.Errorf("itemCodec Encode failed, err=%v", err)
+			return errors.Wrap(errors.ErrEncode, "itemCodec Encode", err)
 		}
 		err = cache.Put(key, value)
 		if err != nil {
-			return fmt.Errorf("put cache failed, err=%v", err)
+			return errors.Wrap(errors.ErrCache, "cache Put", err)
 		}
 	}
 	return nil
@@ -216,58 +732,411 @@ func (c *cachedCallerImpl) setItemsToCache(items []*Item, forceUpdateTs ...bool)
 
 func (c *cachedCallerImpl) Init(caller Caller, opts ...Option) error {
 	c.caller = caller
-	c.config = DefaultConfig()
+	config := DefaultConfig()
+	c.inflight = newInflightGroup()
+	c.revalidator = newRevalidator(defaultRevalidateQueueSize)
+	for _, opt := range opts {
+		err := opt(config)
+		if err != nil {
+			return err
+		}
+	}
+	err := config.validate()
+	if err != nil {
+		return err
+	}
+	err = initPlugins(config, true)
+	if err != nil {
+		return err
+	}
+	if config.defaultCache {
+		config.cache = NewBigCaching()
+		config.defaultCache = false
+	}
+	c.config.Store(config)
+	c.done = make(chan struct{})
+	c.released = make(chan struct{})
+	c.reloaded = make(chan struct{}, 1)
+	if config.warmUpPath != "" {
+		c.warmUp()
+	}
+	if config.cache != nil {
+		c.goBackground(c.backgroundUpdate)
+	}
+	if config.cacheDumpPath != "" {
+		c.goBackground(c.dumpLoop)
+	}
+	return nil
+}
+
+// envAware 需要使用CachedCaller日志和监控的内置插件实现
+type envAware interface {
+	setEnv(logger Logger, monitor Monitor)
+}
+
+// initPlugins 注入日志和监控，initTransCtrl为true时初始化拥塞控制
+func initPlugins(config *Config, initTransCtrl bool) error {
+	for _, plugin := range []interface{}{config.transCtrl, config.concurrencyLimiter, config.itemCodec} {
+		if e, ok := plugin.(envAware); ok {
+			e.setEnv(config.logger, config.monitor)
+		}
+	}
+	if !initTransCtrl {
+		return nil
+	}
+	err := config.transCtrl.Init(config.transCtrlConfig)
+	if err != nil {
+		return fmt.Errorf("transCtrl Init failed, err=%v", err)
+	}
+	return nil
+}
+
+// cfg 当前生效的配置，Reconfigure会整体替换，取到的*Config不会被修改
+func (c *cachedCallerImpl) cfg() *Config {
+	return c.config.Load().(*Config)
+}
+
+// Reconfigure 在线替换可调整的配置：拥塞控制及其配置、并发限制、QPS限制、后台更新的BackgroundUpdater、间隔、超时、批次大小和并发数，
+// 其余配置（编解码器、缓存、dump、预热、监控、日志）不能在线修改
+func (c *cachedCallerImpl) Reconfigure(opts ...Option) error {
+	c.reconfigureLock.Lock()
+	defer c.reconfigureLock.Unlock()
+	old := c.cfg()
+	probe := &Config{defaultCache: true}
+	next := *old
 	for _, opt := range opts {
-		err := opt(c.config)
+		err := opt(probe)
+		if err != nil {
+			return err
+		}
+		err = opt(&next)
 		if err != nil {
 			return err
 		}
 	}
-	if c.config.backgroundUpdater != nil {
-		go c.backgroundUpdate()
+	err := probe.checkReconfigurable()
+	if err != nil {
+		return err
 	}
+	err = next.validate()
+	if err != nil {
+		return err
+	}
+	// 只有修改了拥塞控制或其配置时才重新Init，避免清空运行中的统计
+	err = initPlugins(&next, probe.transCtrl != nil || probe.transCtrlConfig != (TransCtrlConfig{}))
+	if err != nil {
+		return err
+	}
+	c.config.Store(&next)
+	select {
+	case c.reloaded <- struct{}{}:
+	default:
+	}
+	next.monitor.Inc("reconfigure")
+	next.logger.Debugf("reconfigure success")
 	return nil
 }
 
+// goBackground 启动受Close管理的后台任务，Close之后不再启动并返回false
+func (c *cachedCallerImpl) goBackground(fn func()) bool {
+	c.bgLock.Lock()
+	defer c.bgLock.Unlock()
+	if c.closed {
+		return false
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// Close 停止后台更新和定时dump，等待进行中的批次完成后做最后一次dump并关闭缓存，
+// ctx超时则不再等待直接返回ctx.Err()
+func (c *cachedCallerImpl) Close(ctx context.Context) error {
+	if c.done == nil {
+		return nil
+	}
+	c.closeOnce.Do(func() {
+		c.bgLock.Lock()
+		c.closed = true
+		close(c.done)
+		c.bgLock.Unlock()
+		go func() {
+			c.wg.Wait()
+			c.closeErr = c.release()
+			close(c.released)
+		}()
+	})
+	select {
+	case <-c.released:
+		return c.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *cachedCallerImpl) release() error {
+	if c.cfg().cacheDumpPath != "" {
+		c.dumpCache()
+	}
+	closer, ok := c.cfg().cache.(io.Closer)
+	if !ok {
+		return nil
+	}
+	err := closer.Close()
+	if err != nil {
+		return fmt.Errorf("close cache failed, err=%v", err)
+	}
+	return nil
+}
+
+// warmUp 从dump文件加载缓存，失败不影响Init，只是冷启动
+func (c *cachedCallerImpl) warmUp() {
+	cache := c.cfg().cache
+	itemCodec := c.cfg().itemCodec
+	updateCheck := c.cfg().backgroundUpdater
+	mon := c.cfg().monitor
+	log := c.cfg().logger
+	path := c.cfg().warmUpPath
+	maxAge := int64(c.cfg().warmUpMaxAge / time.Second)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		mon.Inc("warmUpNoDump")
+		log.Debugf("warm up dump %v not exist, cold start", path)
+		return
+	}
+	if err != nil {
+		mon.Inc("warmUpFail")
+		log.Errorf("open warm up dump %v failed, err=%v", path, err)
+		return
+	}
+	defer f.Close()
+	now := utils.NowTS()
+	loaded, skipped, corrupt := 0, 0, 0
+	stale := make([]*Item, 0)
+	stats, err := readDump(f, func(key string, value []byte) error {
+		item, err := itemCodec.Decode(key, value)
+		if err != nil {
+			corrupt++
+			return nil
+		}
+		if maxAge > 0 && now-item.TS > maxAge {
+			skipped++
+			return nil
+		}
+		err = cache.Put(key, value)
+		if err != nil {
+			return fmt.Errorf("put cache failed, err=%v", err)
+		}
+		loaded++
+		if c.cfg().warmUpRefreshStale && updateCheck != nil && updateCheck.NeedUpdate(item) {
+			stale = append(stale, item)
+		}
+		return nil
+	})
+	corrupt += stats.corrupt
+	mon.Inc("warmUpLoaded", loaded)
+	mon.Inc("warmUpSkipped", skipped)
+	mon.Inc("warmUpCorrupt", corrupt)
+	mon.Inc("warmUpStale", len(stale))
+	if err != nil {
+		mon.Inc("warmUpFail")
+		log.Errorf("read warm up dump %v failed, err=%v", path, err)
+	}
+	log.Debugf("warm up from %v loaded=%v, skipped=%v, corrupt=%v, stale=%v",
+		path, loaded, skipped, corrupt, len(stale))
+	if len(stale) > 0 {
+		c.goBackground(func() {
+			c.updateCacheInBatches(stale)
+		})
+	}
+}
+
+// dumpLoop 定时dump缓存，关闭时的最后一次dump由Close完成
+func (c *cachedCallerImpl) dumpLoop() {
+	ticker := time.NewTicker(c.cfg().cacheDumpDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.dumpCache()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// dumpCache 先写临时文件再rename，保证dump文件始终完整
+func (c *cachedCallerImpl) dumpCache() {
+	mon := c.cfg().monitor
+	log := c.cfg().logger
+	dumpable, ok := c.cfg().cache.(CacheDumpable)
+	if !ok {
+		mon.Inc("cacheNotDumpable")
+		log.Errorf("cache not dumpable can not dump")
+		return
+	}
+	start := time.Now()
+	path := c.cfg().cacheDumpPath
+	err := dumpToFile(dumpable, path)
+	if err != nil {
+		mon.Inc("dumpFail")
+		log.Errorf("dump cache to %v failed, err=%v", path, err)
+		return
+	}
+	mon.Inc("dumpSuccess")
+	log.Debugf("dump cache to %v cost=%v", path, time.Since(start))
+}
+
+func dumpToFile(dumpable CacheDumpable, path string) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file failed, err=%v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	err = dumpable.Dump(tmp)
+	if err != nil {
+		return fmt.Errorf("dump failed, err=%v", err)
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return fmt.Errorf("sync failed, err=%v", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("close failed, err=%v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// backgroundUpdate BackgroundUpdater为nil时跳过本轮，Reconfigure修改间隔后重建ticker
 func (c *cachedCallerImpl) backgroundUpdate() {
-	duration := c.config.backgroundUpdateDuration
-	cache := c.config.cache
-	log := c.config.logger
-	iterCache, ok := cache.(IterableCache)
-	mon := c.config.monitor
-	batchRequestNum := c.config.backgroundUpdateBatchNum
+	config := c.cfg()
+	iterCache, ok := config.cache.(IterableCache)
 	if !ok {
-		mon.Inc("cacheNotIterable")
-		log.Errorf("cache not iterable can not backgroundUpdate")
+		if config.backgroundUpdater != nil {
+			config.monitor.Inc("cacheNotIterable")
+			config.logger.Errorf("cache not iterable can not backgroundUpdate")
+		}
 		return
 	}
-	for range time.Tick(duration) {
+	duration := config.backgroundUpdateDuration
+	ticker := time.NewTicker(duration)
+	defer func() {
+		ticker.Stop()
+	}()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.reloaded:
+			if c.cfg().backgroundUpdateDuration != duration {
+				duration = c.cfg().backgroundUpdateDuration
+				ticker.Stop()
+				ticker = time.NewTicker(duration)
+			}
+			continue
+		case <-c.done:
+			return
+		}
+		if c.cfg().backgroundUpdater == nil {
+			continue
+		}
 		iter := iterCache.GetIter()
 		items := c.getNeedUpdateItems(iter)
-		for k := 0; k < (len(items)/batchRequestNum + 1); k++ {
-			end := (k + 1) * batchRequestNum
-			if end > len(items) {
-				end = len(items)
+		c.updateCacheInBatches(items)
+	}
+}
+
+// updateCacheInBatches 按批次并发刷新缓存，最多backgroundUpdateParallelNum个批次同时进行，
+// 一轮最长backgroundUpdateDuration，到期或关闭时尚未开始的批次直接丢弃，避免与下一轮重叠；降级时跳过批次
+func (c *cachedCallerImpl) updateCacheInBatches(items []*Item) {
+	batchRequestNum := c.cfg().backgroundUpdateBatchNum
+	parallelNum := c.cfg().backgroundUpdateParallelNum
+	mon := c.cfg().monitor
+	log := c.cfg().logger
+	if parallelNum <= 0 {
+		parallelNum = 1
+	}
+	start := time.Now()
+	deadline := time.NewTimer(c.cfg().backgroundUpdateDuration)
+	defer deadline.Stop()
+	batches := make(chan []*Item)
+	wg := sync.WaitGroup{}
+	for i := 0; i < parallelNum; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if c.degrading() {
+					mon.Inc("bgDegradeDropped", len(batch))
+					continue
+				}
+				mon.Inc("bgBatchInFlight", 1)
+				c.updateCache(batch)
+				mon.Inc("bgBatchInFlight", -1)
 			}
-			c.updateCache(items[k*batchRequestNum : end])
+		}()
+	}
+	batchNum := (len(items) + batchRequestNum - 1) / batchRequestNum
+	sent := 0
+dispatch:
+	for ; sent < batchNum; sent++ {
+		end := (sent + 1) * batchRequestNum
+		if end > len(items) {
+			end = len(items)
+		}
+		select {
+		case batches <- items[sent*batchRequestNum : end]:
+		case <-deadline.C:
+			mon.Inc("bgRoundDeadline")
+			break dispatch
+		case <-c.done:
+			break dispatch
 		}
 	}
+	close(batches)
+	wg.Wait()
+	cost := time.Since(start)
+	mon.Inc("bgRound")
+	mon.Inc("bgRoundMs", int(cost/time.Millisecond))
+	mon.Inc("bgBatchDropped", batchNum-sent)
+	log.Debugf("updateCacheInBatches batchNum=%v, dropped=%v, cost=%v", batchNum, batchNum-sent, cost)
 }
 
+// updateCache 与前台调用一样通过rsp2Items合并回包，只写入和通知下游返回了数据或确认不存在的item
 func (c *cachedCallerImpl) updateCache(items []*Item) {
-	reqCodec := c.config.reqCodec
-	rspCodec := c.config.rspCodec
-	timeout := c.config.backgroundUpdateTimeout
+	reqCodec := c.cfg().reqCodec
+	timeout := c.cfg().backgroundUpdateTimeout
+	mon := c.cfg().monitor
+	log := c.cfg().logger
+	items = c.claimBackgroundItems(items)
+	if len(items) <= 0 {
+		return
+	}
+	keys := itemKeys(items)
+	var results []*Item
+	defer func() {
+		c.inflight.release(keys, results)
+	}()
 	req, err := reqCodec.Decode(items)
-	mon := c.config.monitor
-	log := c.config.logger
 	if err != nil {
 		mon.Inc("reqCodecDecodeFail")
 		log.Errorf("reqCodec Decode failed, err=%v", err)
 		return
 	}
-	rsp, delta, err := c.realCall(context.Background(), timeout, req)
-	c.reportTransCtrl(delta, timeout, err)
+	rsp, delta, err := c.realCall(context.Background(), TrafficBackground, timeout, req, nil)
+	if isLimited(err) {
+		mon.Inc("bgLimited")
+		return
+	}
+	c.reportTransCtrl(TrafficBackground, delta, timeout, err)
 	if err != nil {
 		mon.Inc("bgRealCallFail")
 		log.Errorf("realCall failed, err=%v", err)
@@ -278,10 +1147,12 @@ func (c *cachedCallerImpl) updateCache(items []*Item) {
 		}
 		return
 	}
-	rspItems, err := rspCodec.Encode(rsp)
+	resolved := make([]*Item, len(items))
+	copy(resolved, items)
+	err = c.rsp2Items(rsp, resolved)
 	if err != nil {
 		mon.Inc("rspCodecEncodeFail")
-		log.Errorf("rspCodec Encode failed, err=%v", err)
+		log.Errorf("rsp2Items failed, err=%v", err)
 		err = c.setItemsToCache(items, true)
 		if err != nil {
 			mon.Inc("bgSetCacheFail")
@@ -289,19 +1160,45 @@ func (c *cachedCallerImpl) updateCache(items []*Item) {
 		}
 		return
 	}
-	err = c.setItemsToCache(rspItems)
+	updated := make([]*Item, 0, len(resolved))
+	for i, item := range resolved {
+		if item != items[i] {
+			updated = append(updated, item)
+		}
+	}
+	err = c.setItemsToCache(updated)
 	if err != nil {
 		mon.Inc("bgSetCacheFail")
 		log.Errorf("setItemsToCache failed, err=%v", err)
+		return
+	}
+	results = updated
+}
+
+// claimBackgroundItems 后台更新跳过已有请求在途的key
+func (c *cachedCallerImpl) claimBackgroundItems(items []*Item) []*Item {
+	idx := make([]int, 0, len(items))
+	for i := range items {
+		idx = append(idx, i)
+	}
+	own, waits := c.inflight.claim(items, idx)
+	c.cfg().monitor.Inc("bgDedupSkip", len(waits))
+	if len(waits) <= 0 {
+		return items
 	}
+	owned := make([]*Item, 0, len(own))
+	for _, i := range own {
+		owned = append(owned, items[i])
+	}
+	return owned
 }
 
 func (c *cachedCallerImpl) getNeedUpdateItems(iter CacheIter) []*Item {
-	log := c.config.logger
-	itemCodec := c.config.itemCodec
-	updateCheck := c.config.backgroundUpdater
+	log := c.cfg().logger
+	itemCodec := c.cfg().itemCodec
+	updateCheck := c.cfg().backgroundUpdater
 	items := make([]*Item, 0, 1000)
-	mon := c.config.monitor
+	mon := c.cfg().monitor
 	keyNum := 0
 	for {
 		key, value, err := iter.Next()
@@ -315,11 +1212,20 @@ func (c *cachedCallerImpl) getNeedUpdateItems(iter CacheIter) []*Item {
 			break
 		}
 		item, err := itemCodec.Decode(key, value)
+		if isBadItem(err) {
+			mon.Inc("badCacheItems")
+			_ = c.cfg().cache.Del(key)
+			continue
+		}
 		if err != nil {
 			mon.Inc("itemDecodeFail")
 			log.Errorf("itemCodec Decode, err=%v", err)
 			break
 		}
+		// 负缓存过期后由前台调用更新
+		if item.Absent {
+			continue
+		}
 		if updateCheck != nil && !updateCheck.NeedUpdate(item) {
 			continue
 		}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/allegro/bigcache/v3"
+	"github.com/davidhacking/cached_caller/errors"
 	"github.com/davidhacking/cached_caller/utils"
 	"github.com/stretchr/testify/assert"
 )
@@ -17,6 +20,26 @@ const (
 	fid1Value = int64(1)
 )
 
+// newTestCaching bigcache默认配置每个实例预分配数百MB，测试使用小配置
+func newTestCaching() Caching {
+	c := bigcache.DefaultConfig(10 * time.Second)
+	c.Shards = 16
+	c.MaxEntriesInWindow = 1000
+	return NewBigCaching(c)
+}
+
+// newTestCachedCaller 使用Feature编解码和测试缓存创建CachedCaller，opts在默认参数之后应用
+func newTestCachedCaller(t *testing.T, caller Caller, opts ...Option) CachedCaller {
+	c := NewCachedCaller()
+	opts = append([]Option{
+		WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+	}, opts...)
+	assert.Nil(t, c.Init(caller, opts...))
+	return c
+}
+
 type FeatureCenterServer struct {
 }
 
@@ -80,9 +103,11 @@ func (v *FeatureReqCodec) Decode(items []*Item) (req Req, err error) {
 	fReq := &FeatureRequest{itemInfos: make([]*ItemInfo, 0, len(items))}
 	for _, i := range items {
 		fItem := &ItemInfo{}
-		err = fItem.Unmarshal(i.Data)
-		if err != nil {
-			return nil, err
+		if len(i.Data) > 0 {
+			err = fItem.Unmarshal(i.Data)
+			if err != nil {
+				return nil, err
+			}
 		}
 		fItem.ItemID = i.Key
 		fReq.itemInfos = append(fReq.itemInfos, fItem)
@@ -158,6 +183,7 @@ func TestCachedCaller(t *testing.T) {
 	}
 	err := c.Init(&VideoFeatureCaller{}, opts...)
 	assert.Nil(t, err)
+	defer c.Close(context.Background())
 	id := "111"
 	req := &FeatureRequest{
 		itemInfos: []*ItemInfo{
@@ -185,6 +211,7 @@ func TestCallInCache(t *testing.T) {
 	}
 	err := c.Init(&VideoFeatureCaller{}, opts...)
 	assert.Nil(t, err)
+	defer c.Close(context.Background())
 	id := "111"
 	req := &FeatureRequest{
 		itemInfos: []*ItemInfo{
@@ -227,6 +254,7 @@ func TestBackgroundUpdate(t *testing.T) {
 	}
 	err := c.Init(&VideoFeatureCaller{}, opts...)
 	assert.Nil(t, err)
+	defer c.Close(context.Background())
 	id := "111"
 	req := &FeatureRequest{
 		itemInfos: []*ItemInfo{
@@ -287,6 +315,7 @@ func TestTransCtrl(t *testing.T) {
 	vc2 := &VideoFeatureCaller2{}
 	err := c.Init(vc2, opts...)
 	assert.Nil(t, err)
+	defer c.Close(context.Background())
 	id := "111"
 	req := &FeatureRequest{
 		itemInfos: []*ItemInfo{
@@ -302,3 +331,861 @@ func TestTransCtrl(t *testing.T) {
 	assert.NotNil(t, rsp)
 	assert.Nil(t, err)
 }
+
+type VideoFeatureCaller3 struct {
+	client  *FeatureCenterServer
+	lock    sync.Mutex
+	callCnt int
+	lastReq *FeatureRequest
+}
+
+func (v *VideoFeatureCaller3) Call(ctx context.Context, timeout time.Duration, req Req) (rsp Rsp, err error) {
+	v.lock.Lock()
+	v.callCnt++
+	v.lastReq = req.(*FeatureRequest)
+	v.lock.Unlock()
+	return v.client.GetFeature(req.(*FeatureRequest))
+}
+
+// stats 后台刷新时在其他协程调用Call，需要加锁读取
+func (v *VideoFeatureCaller3) stats() (callCnt int, lastReq *FeatureRequest) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.callCnt, v.lastReq
+}
+
+func TestPartialMiss(t *testing.T) {
+	c := NewCachedCaller()
+	opts := []Option{
+		WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+	}
+	vc3 := &VideoFeatureCaller3{}
+	err := c.Init(vc3, opts...)
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, vc3.callCnt)
+
+	rsp, err := c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, vc3.callCnt)
+	assert.Equal(t, 1, len(vc3.lastReq.itemInfos))
+	assert.Equal(t, "222", vc3.lastReq.itemInfos[0].ItemID)
+	cRsp := rsp.(*FeatureResponse)
+	assert.Equal(t, 2, len(cRsp.itemInfos))
+	for _, info := range cRsp.itemInfos {
+		assert.Equal(t, fid1Value, info.Feature[fid1].IntVal)
+	}
+
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, vc3.callCnt)
+}
+
+type SlowFeatureCaller struct {
+	client *FeatureCenterServer
+	sleep  time.Duration
+}
+
+func (v *SlowFeatureCaller) Call(ctx context.Context, timeout time.Duration, req Req) (rsp Rsp, err error) {
+	time.Sleep(v.sleep)
+	return v.client.GetFeature(req.(*FeatureRequest))
+}
+
+func TestCallTimeout(t *testing.T) {
+	c := newTestCachedCaller(t, &SlowFeatureCaller{sleep: 300 * time.Millisecond})
+	defer c.Close(context.Background())
+	start := time.Now()
+	rsp, err := c.Call(context.Background(), 100*time.Millisecond, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.True(t, time.Since(start) < 200*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Nil(t, rsp)
+
+	slow := &SlowFeatureCaller{}
+	c2 := newTestCachedCaller(t, slow)
+	defer c2.Close(context.Background())
+	_, err = c2.Call(context.Background(), 100*time.Millisecond, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.Nil(t, err)
+	slow.sleep = 300 * time.Millisecond
+	start = time.Now()
+	rsp, err = c2.Call(context.Background(), 100*time.Millisecond, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}},
+	})
+	assert.True(t, time.Since(start) < 200*time.Millisecond)
+	assert.True(t, errors.Is(err, errors.ErrPartialResult))
+	assert.True(t, errors.Is(err, errors.ErrCallTimeout))
+	cRsp := rsp.(*FeatureResponse)
+	assert.Equal(t, fid1Value, cRsp.itemInfos[0].Feature[fid1].IntVal)
+	assert.Nil(t, cRsp.itemInfos[1].Feature)
+
+	time.Sleep(300 * time.Millisecond)
+	rsp, err = c2.(FindInCacheCaller).CallInCache(&FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "222"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, fid1Value, rsp.(*FeatureResponse).itemInfos[0].Feature[fid1].IntVal)
+
+	// 迟到的结果不覆盖调用期间写入的更新数据
+	c3 := newTestCachedCaller(t, &SlowFeatureCaller{sleep: 100 * time.Millisecond}).(*cachedCallerImpl)
+	defer c3.Close(context.Background())
+	_, err = c3.Call(context.Background(), 20*time.Millisecond, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "333"}},
+	})
+	assert.True(t, errors.Is(err, errors.ErrCallTimeout))
+	assert.Nil(t, c3.setItemsToCache([]*Item{{Key: "333", Data: []byte("{}")}}))
+	time.Sleep(200 * time.Millisecond)
+	items := []*Item{{Key: "333"}}
+	assert.Nil(t, c3.findItemByCache(items))
+	assert.Equal(t, "{}", string(items[0].Data))
+}
+
+type recordTransCtrl struct {
+	lock    sync.Mutex
+	inits   int
+	reports []TransType
+}
+
+func (r *recordTransCtrl) Degrade() bool { return false }
+func (r *recordTransCtrl) Init(config TransCtrlConfig) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.inits++
+	return nil
+}
+func (r *recordTransCtrl) Report(t TransType) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reports = append(r.reports, t)
+}
+
+func TestCallCanceled(t *testing.T) {
+	ctrl := &recordTransCtrl{}
+	l, err := NewAIMDLimiter(DefaultAIMDLimiterConfig(), nil)
+	assert.Nil(t, err)
+	limiter := l.(*aimdLimiter)
+	c := NewCachedCaller()
+	err = c.Init(&SlowFeatureCaller{sleep: 100 * time.Millisecond},
+		WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+		WithTransCtrl(ctrl),
+		WithConcurrencyLimiter(limiter),
+	)
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	limit := limiter.Limit()
+
+	// 调用方取消不计为下游失败或超时，也不缩小并发限制
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	rsp, err := c.Call(ctx, time.Second, &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "111"}}})
+	assert.Nil(t, rsp)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.False(t, errors.Is(err, errors.ErrCallTimeout))
+	assert.Eventually(t, func() bool {
+		limiter.lock.Lock()
+		defer limiter.lock.Unlock()
+		return limiter.inflight == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, limit, limiter.Limit())
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+	assert.Empty(t, ctrl.reports)
+}
+
+type FailFeatureCaller struct {
+	err   error
+	sleep time.Duration
+}
+
+func (f *FailFeatureCaller) Call(ctx context.Context, timeout time.Duration, req Req) (rsp Rsp, err error) {
+	time.Sleep(f.sleep)
+	return nil, f.err
+}
+
+func TestCallErrorKind(t *testing.T) {
+	downstreamErr := fmt.Errorf("downstream err")
+	c := NewCachedCaller()
+	err := c.Init(&FailFeatureCaller{err: downstreamErr},
+		WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+		WithTransCtrl(&noDegradeTransCtrl{}),
+	)
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{})
+	assert.True(t, errors.Is(err, errors.ErrEncode))
+
+	rsp, err := c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.Nil(t, rsp)
+	assert.True(t, errors.Is(err, errors.ErrDownstream))
+	assert.False(t, errors.Is(err, errors.ErrPartialResult))
+	var callErr *errors.CallError
+	assert.True(t, errors.As(err, &callErr))
+	assert.Equal(t, errors.ErrDownstream, callErr.Kind)
+	assert.True(t, errors.Is(err, downstreamErr))
+
+	// 111已在缓存中，222下游失败时返回部分结果
+	err = c.(*cachedCallerImpl).setItemsToCache([]*Item{{Key: "111", Data: []byte("{}")}})
+	assert.Nil(t, err)
+	rsp, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}},
+	})
+	assert.NotNil(t, rsp)
+	assert.True(t, errors.Is(err, errors.ErrPartialResult))
+	assert.True(t, errors.Is(err, downstreamErr))
+
+	// 降级时返回缓存中已有的数据且不返回错误，通过meta区分被降级的item
+	assert.Nil(t, c.(Reconfigurer).Reconfigure(WithTransCtrl(&alwaysDegradeTransCtrl{})))
+	rsp, meta, err := c.(MetaCaller).CallWithMeta(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}},
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, rsp)
+	assert.Equal(t, ItemSourceDegraded, meta["111"].Source)
+	assert.False(t, meta["111"].Degraded)
+	assert.Equal(t, ItemSourceNone, meta["222"].Source)
+	assert.True(t, meta["222"].Degraded)
+
+	// 没有缓存时降级返回ErrDegraded
+	c2 := NewCachedCaller()
+	err = c2.Init(&FailFeatureCaller{err: downstreamErr}, WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}), WithCache(nil), WithBackgroundUpdater(nil),
+		WithTransCtrl(&alwaysDegradeTransCtrl{}))
+	assert.Nil(t, err)
+	defer c2.Close(context.Background())
+	_, err = c2.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.True(t, errors.Is(err, errors.ErrDegraded))
+}
+
+func TestCallWithMeta(t *testing.T) {
+	newCaller := func(caller Caller) CachedCaller {
+		c := newTestCachedCaller(t, caller, WithTransCtrl(&noDegradeTransCtrl{}))
+		err := c.(*cachedCallerImpl).setItemsToCache([]*Item{{Key: "111", TS: utils.NowTS() - 100, Data: []byte("{}")}})
+		assert.Nil(t, err)
+		return c
+	}
+	req := &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}},
+	}
+
+	c := newCaller(&VideoFeatureCaller{})
+	defer c.Close(context.Background())
+	rsp, meta, err := c.(MetaCaller).CallWithMeta(context.Background(), time.Second, req)
+	assert.Nil(t, err)
+	assert.NotNil(t, rsp)
+	assert.Equal(t, ItemSourceCache, meta["111"].Source)
+	assert.True(t, meta["111"].Age >= 99*time.Second)
+	assert.Equal(t, ItemSourceDownstream, meta["222"].Source)
+	assert.Equal(t, time.Duration(0), meta["222"].Age)
+	assert.False(t, meta["222"].DownstreamFailed)
+
+	c2 := newCaller(&FailFeatureCaller{err: fmt.Errorf("downstream err")})
+	defer c2.Close(context.Background())
+	rsp, meta, err = c2.(MetaCaller).CallWithMeta(context.Background(), time.Second, req)
+	assert.True(t, errors.Is(err, errors.ErrPartialResult))
+	assert.NotNil(t, rsp)
+	assert.Equal(t, ItemSourceCache, meta["111"].Source)
+	assert.False(t, meta["111"].DownstreamFailed)
+	assert.Equal(t, ItemSourceNone, meta["222"].Source)
+	assert.True(t, meta["222"].DownstreamFailed)
+}
+
+type KnownFeatureCaller struct {
+	known   map[string]bool
+	sleep   time.Duration
+	callCnt int
+	lastReq *FeatureRequest
+}
+
+func (k *KnownFeatureCaller) Call(ctx context.Context, timeout time.Duration, req Req) (rsp Rsp, err error) {
+	time.Sleep(k.sleep)
+	k.callCnt++
+	k.lastReq = req.(*FeatureRequest)
+	fRsp := &FeatureResponse{}
+	for _, item := range k.lastReq.itemInfos {
+		if !k.known[item.ItemID] {
+			continue
+		}
+		fRsp.itemInfos = append(fRsp.itemInfos, &ItemInfo{
+			ItemID:  item.ItemID,
+			Feature: map[int32]*Feature{fid1: {IntVal: fid1Value}},
+		})
+	}
+	return fRsp, nil
+}
+
+func TestNegativeCache(t *testing.T) {
+	caller := &KnownFeatureCaller{known: map[string]bool{"111": true}}
+	c := NewCachedCaller()
+	err := c.Init(caller,
+		WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+		WithNegativeCache(time.Minute),
+	)
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	req := &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "404"}},
+	}
+	_, err = c.Call(context.Background(), time.Second, req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, caller.callCnt)
+
+	rsp, meta, err := c.(MetaCaller).CallWithMeta(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "404"}, {ItemID: "222"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, caller.callCnt)
+	assert.Equal(t, 1, len(caller.lastReq.itemInfos))
+	assert.Equal(t, "222", caller.lastReq.itemInfos[0].ItemID)
+	assert.Nil(t, rsp.(*FeatureResponse).itemInfos[1].Feature)
+	assert.True(t, meta["404"].Absent)
+	assert.Equal(t, ItemSourceCache, meta["404"].Source)
+	assert.True(t, meta["222"].Absent)
+
+	rsp, err = c.(FindInCacheCaller).CallInCache(&FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "404"}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, rsp.(*FeatureResponse).itemInfos[0].Feature)
+
+	// 关闭负缓存后重新调用下游
+	err = c.(Reconfigurer).Reconfigure(WithNegativeCache(0))
+	assert.Nil(t, err)
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "404"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, caller.callCnt)
+}
+
+func TestNegativeCacheWaitBackground(t *testing.T) {
+	caller := &KnownFeatureCaller{known: map[string]bool{"111": true}, sleep: 100 * time.Millisecond}
+	c := newTestCachedCaller(t, caller, WithNegativeCache(time.Minute), WithBackgroundUpdater(nil)).(*cachedCallerImpl)
+	defer c.Close(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.updateCache([]*Item{{Key: "111"}, {Key: "404"}})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// 等待后台更新的在途调用时，下游没有返回的key与自己调用下游一样得到不存在标记
+	rsp, meta, err := c.CallWithMeta(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "404"}},
+	})
+	<-done
+	assert.Nil(t, err)
+	assert.Equal(t, fid1Value, rsp.(*FeatureResponse).itemInfos[0].Feature[fid1].IntVal)
+	assert.Equal(t, ItemSourceDownstream, meta["404"].Source)
+	assert.True(t, meta["404"].Absent)
+	assert.Equal(t, 1, caller.callCnt)
+	items := []*Item{{Key: "404"}}
+	assert.Nil(t, c.findItemByCache(items))
+	assert.True(t, items[0].Absent)
+}
+
+func TestItemTTL(t *testing.T) {
+	newCaller := func(caller Caller) CachedCaller {
+		c := newTestCachedCaller(t, caller, WithTransCtrl(&noDegradeTransCtrl{}))
+		ts := utils.NowTS() - 100
+		err := c.(*cachedCallerImpl).setItemsToCache([]*Item{
+			{Key: "111", TS: ts, Data: []byte("{}"), SoftTTL: 10 * time.Second, HardTTL: time.Hour},
+			{Key: "222", TS: ts, Data: []byte("{}"), HardTTL: 50 * time.Second},
+			{Key: "333", TS: ts, Data: []byte("{}"), SoftTTL: time.Hour},
+		})
+		assert.Nil(t, err)
+		return c
+	}
+	caller := &KnownFeatureCaller{known: map[string]bool{"111": true, "222": true, "333": true}}
+	c := newCaller(caller)
+	defer c.Close(context.Background())
+
+	rsp, err := c.(FindInCacheCaller).CallInCache(&FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}, {ItemID: "333"}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, rsp.(*FeatureResponse).itemInfos[1].Feature)
+	_, err = c.(*cachedCallerImpl).cfg().cache.Get("222")
+	assert.NotNil(t, err)
+
+	rsp, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}, {ItemID: "333"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, caller.callCnt)
+	assert.Equal(t, 2, len(caller.lastReq.itemInfos))
+	assert.Equal(t, "111", caller.lastReq.itemInfos[0].ItemID)
+	assert.Equal(t, "222", caller.lastReq.itemInfos[1].ItemID)
+	assert.Equal(t, fid1Value, rsp.(*FeatureResponse).itemInfos[0].Feature[fid1].IntVal)
+
+	// 刷新失败时返回超过SoftTTL的数据
+	c2 := newCaller(&FailFeatureCaller{err: fmt.Errorf("downstream err")})
+	defer c2.Close(context.Background())
+	rsp, meta, err := c2.(MetaCaller).CallWithMeta(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.True(t, errors.Is(err, errors.ErrPartialResult))
+	assert.Equal(t, 1, len(rsp.(*FeatureResponse).itemInfos))
+	assert.Equal(t, ItemSourceCache, meta["111"].Source)
+	assert.True(t, meta["111"].DownstreamFailed)
+	assert.True(t, meta["111"].Age >= 99*time.Second)
+}
+
+func TestDegradeKeepAliveTS(t *testing.T) {
+	caller := &VideoFeatureCaller3{}
+	c := newTestCachedCaller(t, caller, WithTransCtrl(&alwaysDegradeTransCtrl{}),
+		WithNegativeCache(time.Hour)).(*cachedCallerImpl)
+	defer c.Close(context.Background())
+	ts := utils.NowTS() - 3600
+	err := c.setItemsToCache([]*Item{
+		{Key: "111", TS: ts, Data: []byte("{}"), SoftTTL: 10 * time.Second},
+		{Key: "404", TS: ts + 1800, Absent: true},
+	})
+	assert.Nil(t, err)
+	req := &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "404"}}}
+	_, err = c.Call(context.Background(), time.Second, req)
+	assert.Nil(t, err)
+
+	// 降级保活不更新TS，过期数据不能变成新数据
+	items := []*Item{{Key: "111"}, {Key: "404"}}
+	assert.Nil(t, c.findItemByCache(items))
+	assert.Equal(t, ts, items[0].TS)
+	assert.True(t, items[0].SoftExpired())
+	assert.Equal(t, ts+1800, items[1].TS)
+	assert.Nil(t, c.Reconfigure(WithTransCtrl(&noDegradeTransCtrl{})))
+	_, meta, err := c.CallWithMeta(context.Background(), time.Second, req)
+	assert.Nil(t, err)
+	assert.Equal(t, ItemSourceDownstream, meta["111"].Source)
+	assert.Equal(t, ItemSourceCache, meta["404"].Source)
+	assert.True(t, meta["404"].Age >= 30*time.Minute)
+	callCnt, _ := caller.stats()
+	assert.Equal(t, 1, callCnt)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	caller := &CountFeatureCaller{}
+	c := NewCachedCaller()
+	err := c.Init(caller,
+		WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+		WithStaleWhileRevalidate(time.Hour),
+	)
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	ts := utils.NowTS() - 100
+	err = c.(*cachedCallerImpl).setItemsToCache([]*Item{
+		{Key: "111", TS: ts, Data: []byte("{}"), SoftTTL: 10 * time.Second},
+		{Key: "222", TS: ts, Data: []byte("{}"), SoftTTL: 10 * time.Second},
+	})
+	assert.Nil(t, err)
+
+	req := &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "111"}}}
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		rsp, err := c.Call(context.Background(), time.Second, req)
+		assert.Nil(t, err)
+		assert.True(t, time.Since(start) < 50*time.Millisecond)
+		assert.Nil(t, rsp.(*FeatureResponse).itemInfos[0].Feature)
+	}
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&caller.callCnt))
+	rsp, err := c.(FindInCacheCaller).CallInCache(req)
+	assert.Nil(t, err)
+	assert.Equal(t, fid1Value, rsp.(*FeatureResponse).itemInfos[0].Feature[fid1].IntVal)
+
+	// 超过SoftTTL+maxStale时同步调用下游
+	err = c.(Reconfigurer).Reconfigure(WithStaleWhileRevalidate(30 * time.Second))
+	assert.Nil(t, err)
+	rsp, err = c.Call(context.Background(), time.Second, &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "222"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, fid1Value, rsp.(*FeatureResponse).itemInfos[0].Feature[fid1].IntVal)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&caller.callCnt))
+}
+
+func TestDefaultItemCodec(t *testing.T) {
+	codec := &defaultItemCodec{}
+	_, value, err := codec.Encode(&Item{Key: "1", TS: 1, Absent: true})
+	assert.Nil(t, err)
+	item, err := codec.Decode("1", value)
+	assert.Nil(t, err)
+	assert.True(t, item.Absent)
+	assert.True(t, item.Empty())
+
+	_, value, err = codec.Encode(&Item{Key: "1", TS: 1, Data: []byte("data")})
+	assert.Nil(t, err)
+	assert.Equal(t, 1+1+8+4+4+4, len(value))
+	item, err = codec.Decode("1", value)
+	assert.Nil(t, err)
+	assert.False(t, item.Absent)
+	assert.Equal(t, []byte("data"), item.Data)
+
+	_, value, err = codec.Encode(&Item{Key: "1", TS: 1, Data: []byte("data"), SoftTTL: time.Second, HardTTL: time.Hour})
+	assert.Nil(t, err)
+	item, err = codec.Decode("1", value)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data"), item.Data)
+	assert.Equal(t, time.Second, item.SoftTTL)
+	assert.Equal(t, time.Hour, item.HardTTL)
+
+	for n := 0; n < len(value); n++ {
+		_, err = codec.Decode("1", value[:n])
+		assert.True(t, errors.Is(err, errors.ErrItemFormat) || errors.Is(err, errors.ErrItemCorrupt))
+	}
+	value[len(value)-5] ^= 0xff
+	_, err = codec.Decode("1", value)
+	assert.True(t, errors.Is(err, errors.ErrItemCorrupt))
+
+	// 无版本号的旧格式
+	legacy := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 4, 'd', 'a', 't', 'a'}
+	item, err = codec.Decode("1", legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), item.TS)
+	assert.Equal(t, []byte("data"), item.Data)
+	item, err = codec.Decode("1", append(legacy, itemFlagAbsent))
+	assert.Nil(t, err)
+	assert.True(t, item.Absent)
+	_, err = codec.Decode("1", append(legacy, itemFlagTTL, 0, 0))
+	assert.True(t, errors.Is(err, errors.ErrItemFormat))
+	_, err = codec.Decode("1", legacy[:14])
+	assert.True(t, errors.Is(err, errors.ErrItemFormat))
+}
+
+type noDegradeTransCtrl struct{}
+
+func (n *noDegradeTransCtrl) Init(config TransCtrlConfig) error { return nil }
+func (n *noDegradeTransCtrl) Report(t TransType)                {}
+func (n *noDegradeTransCtrl) Degrade() bool                     { return false }
+
+type CountFeatureCaller struct {
+	client  *FeatureCenterServer
+	callCnt int32
+}
+
+func (v *CountFeatureCaller) Call(ctx context.Context, timeout time.Duration, req Req) (rsp Rsp, err error) {
+	atomic.AddInt32(&v.callCnt, 1)
+	time.Sleep(100 * time.Millisecond)
+	return v.client.GetFeature(req.(*FeatureRequest))
+}
+
+func TestTransTypeOf(t *testing.T) {
+	assert.Equal(t, TransTypeSuccess, transTypeOf(time.Millisecond, 0, nil))
+	assert.Equal(t, TransTypeFail, transTypeOf(time.Millisecond, 0, fmt.Errorf("fail")))
+	assert.Equal(t, TransTypeTimeout, transTypeOf(2*time.Millisecond, time.Millisecond, nil))
+	assert.Equal(t, TransTypeTimeout, transTypeOf(0, time.Second, errors.ErrCallTimeout))
+}
+
+type alwaysDegradeTransCtrl struct{}
+
+func (a *alwaysDegradeTransCtrl) Init(config TransCtrlConfig) error { return nil }
+func (a *alwaysDegradeTransCtrl) Report(t TransType)                {}
+func (a *alwaysDegradeTransCtrl) Degrade() bool                     { return true }
+func (a *alwaysDegradeTransCtrl) Degrading() bool                   { return true }
+
+func TestDegradeChecker(t *testing.T) {
+	d := &defaultTransCtrl{degradeCnt: 1}
+	// Degrading不消耗降级名额
+	assert.True(t, d.Degrading())
+	assert.True(t, d.Degrading())
+	assert.True(t, d.Degrade())
+	assert.False(t, d.Degrading())
+	assert.False(t, d.Degrade())
+}
+
+func TestRevalidateDegrade(t *testing.T) {
+	caller := &CountFeatureCaller{}
+	mon := &countMonitor{counts: map[string]int{}}
+	c := NewCachedCaller()
+	err := c.Init(caller, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()), WithTransCtrl(&alwaysDegradeTransCtrl{}), WithMonitor(mon))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	impl := c.(*cachedCallerImpl)
+	ts := utils.NowTS() - 100
+	err = impl.setItemsToCache([]*Item{{Key: "111", TS: ts, Data: []byte("{}"), SoftTTL: 10 * time.Second}})
+	assert.Nil(t, err)
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "222"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&impl.swrWorkers))
+
+	// 降级时不刷新过期数据
+	assert.Nil(t, impl.Reconfigure(WithStaleWhileRevalidate(time.Hour)))
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "111"}}})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		mon.lock.Lock()
+		defer mon.lock.Unlock()
+		return mon.counts["swrDegradeDropped"] == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&caller.callCnt))
+	// 后台更新同样跳过
+	impl.updateCacheInBatches([]*Item{{Key: "111"}})
+	assert.Equal(t, int32(0), atomic.LoadInt32(&caller.callCnt))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&impl.swrWorkers))
+}
+
+func TestCorruptCacheItem(t *testing.T) {
+	c := NewCachedCaller()
+	cache := newTestCaching()
+	vc3 := &VideoFeatureCaller3{}
+	err := c.Init(vc3, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}), WithCache(cache),
+		WithBackgroundUpdater(nil))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	req := &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "111"}}}
+	assert.Nil(t, cache.Put("111", []byte{itemCodecVersion1, 0, 0}))
+
+	rsp, err := c.Call(context.Background(), time.Second, req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, vc3.callCnt)
+	assert.Equal(t, fid1Value, rsp.(*FeatureResponse).itemInfos[0].Feature[fid1].IntVal)
+	_, err = c.Call(context.Background(), time.Second, req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, vc3.callCnt)
+
+	// 后台更新跳过损坏的item，不影响本轮其它item
+	assert.Nil(t, cache.Put("222", []byte{itemCodecVersion1, 0, 0}))
+	items := c.(*cachedCallerImpl).getNeedUpdateItems(cache.(IterableCache).GetIter())
+	assert.Equal(t, 1, len(items))
+	assert.Equal(t, "111", items[0].Key)
+	_, err = cache.Get("222")
+	assert.NotNil(t, err)
+}
+
+func TestInflightDedup(t *testing.T) {
+	c := NewCachedCaller()
+	opts := []Option{
+		WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+	}
+	cc := &CountFeatureCaller{}
+	err := c.Init(cc, opts...)
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := c.Call(context.Background(), time.Second, &FeatureRequest{
+				itemInfos: []*ItemInfo{{ItemID: "111"}},
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, fid1Value, rsp.(*FeatureResponse).itemInfos[0].Feature[fid1].IntVal)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cc.callCnt))
+
+	// 等待其他调用超时时，已命中缓存的数据连同ErrPartialResult返回
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := c.Call(context.Background(), time.Second, &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "222"}}})
+		assert.Nil(t, err)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	rsp, meta, err := c.(MetaCaller).CallWithMeta(context.Background(), 30*time.Millisecond, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}},
+	})
+	assert.True(t, errors.Is(err, errors.ErrPartialResult))
+	assert.True(t, errors.Is(err, errors.ErrCallTimeout))
+	assert.Equal(t, fid1Value, rsp.(*FeatureResponse).itemInfos[0].Feature[fid1].IntVal)
+	assert.True(t, meta["222"].DownstreamFailed)
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cc.callCnt))
+}
+
+func TestWaitInflightTimeout(t *testing.T) {
+	c := NewCachedCaller()
+	err := c.Init(&VideoFeatureCaller{}, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	impl := c.(*cachedCallerImpl)
+	items := make([]*Item, 10)
+	idx := make([]int, 0, len(items))
+	for i := range items {
+		items[i] = &Item{Key: fmt.Sprint(i)}
+		idx = append(idx, i)
+	}
+	// 除最后一个外都已完成，等待超时时已完成的也要合并
+	_, _ = impl.inflight.claim(items, idx)
+	results := make([]*Item, 0, len(items)-1)
+	for _, item := range items[:len(items)-1] {
+		results = append(results, &Item{Key: item.Key, TS: 1, Data: []byte("{}")})
+	}
+	waitItems := make([]*Item, len(items))
+	for i, item := range items {
+		waitItems[i] = &Item{Key: item.Key}
+	}
+	_, waits := impl.inflight.claim(waitItems, idx)
+	impl.inflight.release(itemKeys(items[:len(items)-1]), results)
+	err = impl.waitInflight(context.Background(), time.Now(), 20*time.Millisecond, waitItems, waits)
+	assert.Equal(t, errors.ErrCallTimeout, err)
+	for i, item := range waitItems {
+		assert.Equal(t, i != len(items)-1, item.Resolved())
+	}
+
+	// 超时后才完成的在途调用没有合并到回包中，不能标记为来自下游
+	last := items[len(items)-1]
+	impl.inflight.release([]string{last.Key}, []*Item{{Key: last.Key, TS: 1, Data: []byte("{}")}})
+	meta := make(CallMeta)
+	metas := newItemMetas(items, meta)
+	metas.fromInflight(waitItems, waits)
+	metas.fill(waitItems, meta)
+	for i, item := range waitItems {
+		merged := i != len(items)-1
+		assert.Equal(t, merged, meta[item.Key].Source == ItemSourceDownstream)
+		assert.Equal(t, !merged, meta[item.Key].DownstreamFailed)
+	}
+}
+
+func TestWaitInflightFail(t *testing.T) {
+	c := NewCachedCaller()
+	err := c.Init(&FailFeatureCaller{err: fmt.Errorf("downstream err"), sleep: 100 * time.Millisecond},
+		WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}), WithCache(newTestCaching()),
+		WithTransCtrl(&noDegradeTransCtrl{}))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	err = c.(*cachedCallerImpl).setItemsToCache([]*Item{{Key: "111", Data: []byte("{}")}})
+	assert.Nil(t, err)
+
+	// 等待的在途调用失败时与自己调用下游失败一样返回ErrPartialResult
+	var ownErr error
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, ownErr = c.Call(context.Background(), time.Second, &FeatureRequest{
+			itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}},
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	rsp, err := c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}},
+	})
+	wg.Wait()
+	assert.True(t, errors.Is(ownErr, errors.ErrPartialResult))
+	assert.NotNil(t, rsp)
+	assert.True(t, errors.Is(err, errors.ErrPartialResult))
+	assert.True(t, errors.Is(err, errors.ErrDownstream))
+}
+
+func TestBackgroundUpdateParallel(t *testing.T) {
+	items := []*Item{{Key: "1"}, {Key: "2"}, {Key: "3"}, {Key: "4"}}
+
+	cc := &CountFeatureCaller{}
+	c := newTestCachedCaller(t, cc, WithBackgroundUpdateDuration(time.Hour),
+		WithBackgroundUpdateBatchNum(1), WithBackgroundUpdateParallelNum(4)).(*cachedCallerImpl)
+	defer c.Close(context.Background())
+	start := time.Now()
+	c.updateCacheInBatches(items)
+	assert.True(t, time.Since(start) < 300*time.Millisecond)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&cc.callCnt))
+
+	cc2 := &CountFeatureCaller{}
+	c2 := newTestCachedCaller(t, cc2, WithBackgroundUpdateDuration(50*time.Millisecond),
+		WithBackgroundUpdateBatchNum(1), WithBackgroundUpdateParallelNum(1)).(*cachedCallerImpl)
+	defer c2.Close(context.Background())
+	c2.updateCacheInBatches(items)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cc2.callCnt))
+}
+
+func TestConfigValidate(t *testing.T) {
+	codecs := []Option{WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{})}
+	transCtrlConfig := DefaultTransCtrlConfig()
+	transCtrlConfig.ErrThreshold = 1.5
+	cases := [][]Option{
+		{WithRspCodec(&FeatureRspCodec{})},
+		append(codecs, WithItemCodec(nil)),
+		append(codecs, WithBackgroundUpdateBatchNum(0)),
+		append(codecs, WithCache(nil)),
+		append(codecs, WithTransCtrlConfig(transCtrlConfig)),
+	}
+	for _, opts := range cases {
+		c := NewCachedCaller()
+		assert.NotNil(t, c.Init(&VideoFeatureCaller{}, opts...))
+		assert.Nil(t, c.(*cachedCallerImpl).config.Load())
+	}
+	assert.Nil(t, DefaultConfig().cache)
+
+	d := NewCachedCaller()
+	assert.Nil(t, d.Init(&VideoFeatureCaller{}, codecs...))
+	_, ok := d.(*cachedCallerImpl).cfg().cache.(*bigCacheDecorator)
+	assert.True(t, ok)
+	assert.Nil(t, d.Close(context.Background()))
+
+	c := NewCachedCaller()
+	err := c.Init(&VideoFeatureCaller{}, append(codecs, WithCache(nil), WithBackgroundUpdater(nil))...)
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.Nil(t, err)
+}
+
+type alwaysUpdater struct {
+}
+
+func (a *alwaysUpdater) NeedUpdate(item *Item) bool {
+	return true
+}
+
+func TestReconfigure(t *testing.T) {
+	c := NewCachedCaller()
+	vc3 := &VideoFeatureCaller3{}
+	ctrl := &recordTransCtrl{}
+	err := c.Init(vc3, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()), WithTransCtrl(ctrl),
+		WithBackgroundUpdater(nil), WithBackgroundUpdateDuration(time.Hour))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.Nil(t, err)
+
+	r := c.(Reconfigurer)
+	assert.NotNil(t, r.Reconfigure(WithCache(newTestCaching())))
+	assert.NotNil(t, r.Reconfigure(WithCache(nil), WithBackgroundUpdater(nil)))
+	assert.NotNil(t, c.(*cachedCallerImpl).cfg().cache)
+	transCtrlConfig := DefaultTransCtrlConfig()
+	transCtrlConfig.TimeoutThreshold = -1
+	assert.NotNil(t, r.Reconfigure(WithTransCtrlConfig(transCtrlConfig)))
+	transCtrlConfig.TimeoutThreshold = 0.5
+	assert.Nil(t, r.Reconfigure(WithTransCtrlConfig(transCtrlConfig),
+		WithBackgroundUpdater(&alwaysUpdater{}), WithBackgroundUpdateDuration(100*time.Millisecond)))
+	time.Sleep(350 * time.Millisecond)
+	assert.Nil(t, r.Reconfigure(WithBackgroundUpdater(nil)))
+	callCnt, _ := vc3.stats()
+	assert.True(t, callCnt > 1)
+	// 只有修改拥塞控制配置时才重新Init
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+	assert.Equal(t, 2, ctrl.inits)
+}
@@ -0,0 +1,268 @@
+package cached_caller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState 熔断器状态
+type CircuitState int
+
+const (
+	// CircuitClosed 正常放行
+	CircuitClosed CircuitState = iota
+	// CircuitOpen 熔断，全部降级
+	CircuitOpen
+	// CircuitHalfOpen 半开，只放行少量探测请求
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerConfig 熔断器配置，失败率和超时率阈值取自TransCtrlConfig
+type CircuitBreakerConfig struct {
+	BucketNum        int           // 滑动窗口桶数
+	BucketDuration   time.Duration // 每个桶的时长，窗口大小为BucketNum*BucketDuration
+	MinRequestNum    int           // 窗口内请求数低于该值时不熔断
+	OpenDuration     time.Duration // 熔断持续时间，之后进入半开
+	HalfOpenProbeNum int           // 半开时放行的探测请求数，全部成功才恢复
+}
+
+// DefaultCircuitBreakerConfig 10秒窗口，至少20个请求，熔断5秒后用5个请求探测
+func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		BucketNum:        10,
+		BucketDuration:   time.Second,
+		MinRequestNum:    20,
+		OpenDuration:     5 * time.Second,
+		HalfOpenProbeNum: 5,
+	}
+}
+
+func (c CircuitBreakerConfig) validate() error {
+	if c.BucketNum <= 0 || c.BucketDuration <= 0 {
+		return fmt.Errorf("invalid circuit breaker config: BucketNum=%v, BucketDuration=%v must be > 0",
+			c.BucketNum, c.BucketDuration)
+	}
+	if c.HalfOpenProbeNum <= 0 {
+		return fmt.Errorf("invalid circuit breaker config: HalfOpenProbeNum=%v must be > 0", c.HalfOpenProbeNum)
+	}
+	if c.MinRequestNum <= 0 || c.OpenDuration <= 0 {
+		return fmt.Errorf("invalid circuit breaker config: MinRequestNum=%v, OpenDuration=%v must be > 0",
+			c.MinRequestNum, c.OpenDuration)
+	}
+	return nil
+}
+
+type circuitBucket struct {
+	index      int64
+	total      int
+	errCnt     int
+	timeoutCnt int
+}
+
+// circuitBreaker 基于时间分桶滑动窗口的TransCtrl实现
+type circuitBreaker struct {
+	lock             sync.Mutex
+	config           CircuitBreakerConfig
+	errThreshold     float64
+	timeoutThreshold float64
+	logger           Logger
+	monitor          Monitor
+	now              func() time.Time
+	buckets          []circuitBucket
+	state            CircuitState
+	openedAt         time.Time
+	halfOpenAt       time.Time
+	probeIssued      int
+	probeSuccess     int
+}
+
+// NewCircuitBreaker 创建熔断器，logger和monitor为nil时使用CachedCaller的配置，config非法时Init返回错误
+func NewCircuitBreaker(config CircuitBreakerConfig, logger Logger, monitor Monitor) TransCtrl {
+	b := &circuitBreaker{
+		config:  config,
+		logger:  logger,
+		monitor: monitor,
+		now:     time.Now,
+	}
+	if config.BucketNum > 0 {
+		b.buckets = make([]circuitBucket, config.BucketNum)
+	}
+	return b
+}
+
+func (b *circuitBreaker) setEnv(logger Logger, monitor Monitor) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.logger == nil {
+		b.logger = logger
+	}
+	if b.monitor == nil {
+		b.monitor = monitor
+	}
+}
+
+func (b *circuitBreaker) Init(config TransCtrlConfig) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.config.validate()
+	if err != nil {
+		return err
+	}
+	if b.logger == nil {
+		b.logger = &defaultLogger{}
+	}
+	if b.monitor == nil {
+		b.monitor = &defaultMonitor{}
+	}
+	b.errThreshold = config.ErrThreshold
+	b.timeoutThreshold = config.TimeoutThreshold
+	return nil
+}
+
+func (b *circuitBreaker) Report(t TransType) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		return
+	case CircuitHalfOpen:
+		// 只统计已放行的探测请求的结果，后台调用通过ReportBackground上报，不计入
+		if b.probeSuccess >= b.probeIssued {
+			return
+		}
+		if t != TransTypeSuccess {
+			b.transit(CircuitOpen)
+			return
+		}
+		b.probeSuccess++
+		if b.probeSuccess >= b.config.HalfOpenProbeNum {
+			b.transit(CircuitClosed)
+		}
+		return
+	}
+	b.record(t)
+}
+
+// ReportBackground 后台调用没有探测名额，只在关闭状态下计入滑动窗口
+func (b *circuitBreaker) ReportBackground(t TransType) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state != CircuitClosed {
+		return
+	}
+	b.record(t)
+}
+
+// record 关闭状态下记录调用结果，失败率或超时率超过阈值时熔断
+func (b *circuitBreaker) record(t TransType) {
+	bucket := b.currentBucket()
+	bucket.total++
+	switch t {
+	case TransTypeFail:
+		bucket.errCnt++
+	case TransTypeTimeout:
+		bucket.timeoutCnt++
+	}
+	total, errCnt, timeoutCnt := b.windowCount()
+	if total < b.config.MinRequestNum || total <= 0 {
+		return
+	}
+	if float64(errCnt)/float64(total) > b.errThreshold ||
+		float64(timeoutCnt)/float64(total) > b.timeoutThreshold {
+		b.transit(CircuitOpen)
+	}
+}
+
+func (b *circuitBreaker) Degrade() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.config.OpenDuration {
+			return true
+		}
+		b.transit(CircuitHalfOpen)
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probeIssued < b.config.HalfOpenProbeNum {
+			b.probeIssued++
+			return false
+		}
+		// 探测请求被限流等原因没有上报结果时，超过OpenDuration重新熔断，之后再次探测
+		if b.now().Sub(b.halfOpenAt) >= b.config.OpenDuration {
+			b.transit(CircuitOpen)
+		}
+		return true
+	}
+	return false
+}
+
+// State 当前熔断状态
+func (b *circuitBreaker) State() CircuitState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Degrading 熔断或半开时视为降级，半开的探测名额只留给前台调用
+func (b *circuitBreaker) Degrading() bool {
+	return b.State() != CircuitClosed
+}
+
+func (b *circuitBreaker) transit(state CircuitState) {
+	from := b.state
+	b.state = state
+	switch state {
+	case CircuitOpen:
+		b.openedAt = b.now()
+		b.monitor.Inc("circuitBreakerOpen")
+		b.logger.Errorf("circuit breaker %v -> %v", from, state)
+		return
+	case CircuitHalfOpen:
+		b.halfOpenAt = b.now()
+		b.probeIssued = 0
+		b.probeSuccess = 0
+		b.monitor.Inc("circuitBreakerHalfOpen")
+	case CircuitClosed:
+		for i := range b.buckets {
+			b.buckets[i] = circuitBucket{}
+		}
+		b.monitor.Inc("circuitBreakerClose")
+	}
+	b.logger.Debugf("circuit breaker %v -> %v", from, state)
+}
+
+func (b *circuitBreaker) currentBucket() *circuitBucket {
+	index := b.now().UnixNano() / int64(b.config.BucketDuration)
+	bucket := &b.buckets[index%int64(len(b.buckets))]
+	if bucket.index != index {
+		*bucket = circuitBucket{index: index}
+	}
+	return bucket
+}
+
+func (b *circuitBreaker) windowCount() (total, errCnt, timeoutCnt int) {
+	index := b.now().UnixNano() / int64(b.config.BucketDuration)
+	for _, bucket := range b.buckets {
+		if index-bucket.index >= int64(len(b.buckets)) {
+			continue
+		}
+		total += bucket.total
+		errCnt += bucket.errCnt
+		timeoutCnt += bucket.timeoutCnt
+	}
+	return total, errCnt, timeoutCnt
+}
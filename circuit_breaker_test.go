@@ -0,0 +1,98 @@
+package cached_caller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	mon := &countMonitor{counts: map[string]int{}}
+	b := NewCircuitBreaker(CircuitBreakerConfig{
+		BucketNum:        10,
+		BucketDuration:   time.Second,
+		MinRequestNum:    4,
+		OpenDuration:     5 * time.Second,
+		HalfOpenProbeNum: 2,
+	}, nil, mon).(*circuitBreaker)
+	b.now = func() time.Time { return now }
+	config := DefaultTransCtrlConfig()
+	config.ErrThreshold = 0.5
+	assert.Nil(t, b.Init(config))
+
+	for i := 0; i < 3; i++ {
+		b.Report(TransTypeFail)
+	}
+	assert.Equal(t, CircuitClosed, b.State())
+	now = now.Add(11 * time.Second)
+	b.Report(TransTypeSuccess)
+	b.Report(TransTypeSuccess)
+	b.Report(TransTypeFail)
+	b.Report(TransTypeFail)
+	assert.Equal(t, CircuitClosed, b.State(), "old buckets are out of window")
+	b.Report(TransTypeFail)
+	assert.Equal(t, CircuitOpen, b.State())
+	assert.True(t, b.Degrade())
+
+	now = now.Add(5 * time.Second)
+	assert.False(t, b.Degrade())
+	assert.Equal(t, CircuitHalfOpen, b.State())
+	assert.False(t, b.Degrade())
+	assert.True(t, b.Degrade())
+	b.Report(TransTypeSuccess)
+	b.Report(TransTypeTimeout)
+	assert.Equal(t, CircuitOpen, b.State())
+
+	now = now.Add(5 * time.Second)
+	assert.False(t, b.Degrade())
+	assert.False(t, b.Degrade())
+	b.Report(TransTypeSuccess)
+	b.Report(TransTypeSuccess)
+	assert.Equal(t, CircuitClosed, b.State())
+	assert.False(t, b.Degrade())
+	assert.Equal(t, 2, mon.counts["circuitBreakerOpen"])
+	assert.Equal(t, 1, mon.counts["circuitBreakerClose"])
+
+	for i := 0; i < 4; i++ {
+		b.Report(TransTypeFail)
+	}
+	assert.Equal(t, CircuitOpen, b.State())
+	now = now.Add(5 * time.Second)
+	// 没有放行探测时的上报不计入，探测被限流而未上报时超过OpenDuration重新熔断
+	assert.False(t, b.Degrade())
+	b.Report(TransTypeSuccess)
+	b.Report(TransTypeSuccess)
+	assert.Equal(t, CircuitHalfOpen, b.State())
+	assert.False(t, b.Degrade())
+	assert.True(t, b.Degrade())
+	now = now.Add(5 * time.Second)
+	assert.True(t, b.Degrade())
+	assert.Equal(t, CircuitOpen, b.State())
+	now = now.Add(5 * time.Second)
+	assert.False(t, b.Degrade())
+	assert.Equal(t, CircuitHalfOpen, b.State())
+	// 后台调用的结果不计入探测，也不会在熔断或半开时调用下游
+	b.ReportBackground(TransTypeSuccess)
+	b.ReportBackground(TransTypeSuccess)
+	assert.Equal(t, CircuitHalfOpen, b.State())
+	assert.True(t, b.Degrading())
+}
+
+func TestCircuitBreakerInvalidConfig(t *testing.T) {
+	c := DefaultCircuitBreakerConfig()
+	c.BucketNum = -1
+	b := NewCircuitBreaker(c, nil, nil)
+	assert.NotNil(t, b.Init(DefaultTransCtrlConfig()))
+	c = DefaultCircuitBreakerConfig()
+	c.MinRequestNum = 0
+	assert.NotNil(t, NewCircuitBreaker(c, nil, nil).Init(DefaultTransCtrlConfig()))
+	c = DefaultCircuitBreakerConfig()
+	c.OpenDuration = 0
+	assert.NotNil(t, NewCircuitBreaker(c, nil, nil).Init(DefaultTransCtrlConfig()))
+
+	_, err := OptionsFromReader(strings.NewReader("trans_ctrl:\n  name: circuit_breaker\n  params:\n    bucket_num: -1\n"))
+	assert.NotNil(t, err)
+}
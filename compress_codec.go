@@ -0,0 +1,242 @@
+package cached_caller
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/davidhacking/cached_caller/errors"
+)
+
+// CompressAlgorithm Item.Data的压缩算法
+type CompressAlgorithm byte
+
+const (
+	CompressNone CompressAlgorithm = iota
+	CompressGzip
+	CompressFlate
+	CompressZlib
+)
+
+func (a CompressAlgorithm) String() string {
+	switch a {
+	case CompressNone:
+		return "none"
+	case CompressGzip:
+		return "gzip"
+	case CompressFlate:
+		return "flate"
+	case CompressZlib:
+		return "zlib"
+	}
+	return fmt.Sprintf("CompressAlgorithm(%d)", byte(a))
+}
+
+// ParseCompressAlgorithm 根据名字选择压缩算法，用于配置文件
+func ParseCompressAlgorithm(name string) (CompressAlgorithm, error) {
+	for _, a := range []CompressAlgorithm{CompressNone, CompressGzip, CompressFlate, CompressZlib} {
+		if a.String() == name {
+			return a, nil
+		}
+	}
+	return CompressNone, fmt.Errorf("unknown compress algorithm %v", name)
+}
+
+// CompressConfig 压缩配置
+type CompressConfig struct {
+	Algorithm CompressAlgorithm
+	Level     int // 压缩级别，取值同compress/flate，0时使用flate.DefaultCompression
+	MinSize   int // Data小于该字节数时不压缩
+}
+
+// DefaultCompressConfig 默认压缩配置
+func DefaultCompressConfig() CompressConfig {
+	return CompressConfig{
+		Algorithm: CompressGzip,
+		Level:     flate.DefaultCompression,
+		MinSize:   256,
+	}
+}
+
+// compressMagic 压缩codec编码结果的首字节，之后为算法字节和内层codec的编码结果，
+// 首字节不是compressMagic的数据是开启压缩前写入的，直接交给内层codec解码
+const compressMagic = byte(0x82)
+
+// compressItemCodec 压缩Item.Data后交给内层codec编码，压缩后没有变小的Data按原样保存
+type compressItemCodec struct {
+	codec   ItemCodec
+	config  CompressConfig
+	lock    sync.Mutex
+	monitor Monitor
+	writers sync.Pool
+}
+
+// NewCompressItemCodec 创建压缩codec，codec为nil时使用默认codec，monitor为nil时使用CachedCaller的配置
+func NewCompressItemCodec(codec ItemCodec, config CompressConfig, monitor Monitor) (ItemCodec, error) {
+	if codec == nil {
+		codec = &defaultItemCodec{}
+	}
+	if config.Level == 0 {
+		config.Level = flate.DefaultCompression
+	}
+	if config.Level < flate.HuffmanOnly || config.Level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid compress level %v", config.Level)
+	}
+	switch config.Algorithm {
+	case CompressNone, CompressGzip, CompressFlate, CompressZlib:
+	default:
+		return nil, fmt.Errorf("invalid compress algorithm %v", config.Algorithm)
+	}
+	return &compressItemCodec{
+		codec:   codec,
+		config:  config,
+		monitor: monitor,
+	}, nil
+}
+
+func (c *compressItemCodec) setEnv(logger Logger, monitor Monitor) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.monitor == nil {
+		c.monitor = monitor
+	}
+	if inner, ok := c.codec.(envAware); ok {
+		inner.setEnv(logger, monitor)
+	}
+}
+
+func (c *compressItemCodec) mon() Monitor {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.monitor == nil {
+		return &defaultMonitor{}
+	}
+	return c.monitor
+}
+
+func (c *compressItemCodec) Encode(item *Item) (key string, value []byte, err error) {
+	algorithm := c.config.Algorithm
+	if len(item.Data) < c.config.MinSize {
+		algorithm = CompressNone
+	}
+	if algorithm != CompressNone {
+		mon := c.mon()
+		start := time.Now()
+		data, err := c.compress(item.Data)
+		if err != nil {
+			return "", nil, err
+		}
+		mon.Inc("itemCompressUs", int(time.Since(start)/time.Microsecond))
+		mon.Inc("itemCompressRawBytes", len(item.Data))
+		if len(data) < len(item.Data) {
+			mon.Inc("itemCompressedBytes", len(data))
+			compressed := *item
+			compressed.Data = data
+			item = &compressed
+		} else {
+			mon.Inc("itemCompressedBytes", len(item.Data))
+			mon.Inc("itemCompressIneffective")
+			algorithm = CompressNone
+		}
+	}
+	key, value, err = c.codec.Encode(item)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, append([]byte{compressMagic, byte(algorithm)}, value...), nil
+}
+
+func (c *compressItemCodec) Decode(key string, value []byte) (item *Item, err error) {
+	if len(value) == 0 || value[0] != compressMagic {
+		return c.codec.Decode(key, value)
+	}
+	if len(value) < 2 {
+		return nil, errors.ErrItemFormat
+	}
+	algorithm := CompressAlgorithm(value[1])
+	item, err = c.codec.Decode(key, value[2:])
+	if err != nil || algorithm == CompressNone {
+		return item, err
+	}
+	start := time.Now()
+	item.Data, err = c.decompress(algorithm, item.Data)
+	if err != nil {
+		return nil, err
+	}
+	c.mon().Inc("itemDecompressUs", int(time.Since(start)/time.Microsecond))
+	return item, nil
+}
+
+// compressWriter 可以Reset复用的压缩writer
+type compressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+func (c *compressItemCodec) newWriter(w io.Writer) (compressWriter, error) {
+	switch c.config.Algorithm {
+	case CompressGzip:
+		return gzip.NewWriterLevel(w, c.config.Level)
+	case CompressFlate:
+		return flate.NewWriter(w, c.config.Level)
+	case CompressZlib:
+		return zlib.NewWriterLevel(w, c.config.Level)
+	}
+	return nil, fmt.Errorf("invalid compress algorithm %v", c.config.Algorithm)
+}
+
+func (c *compressItemCodec) compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	w, ok := c.writers.Get().(compressWriter)
+	if ok {
+		w.Reset(buf)
+	} else {
+		var err error
+		w, err = c.newWriter(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer c.writers.Put(w)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v compress failed, err=%v", c.config.Algorithm, err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%v compress failed, err=%v", c.config.Algorithm, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress 按写入时记录的算法解压，与当前配置的算法无关，切换算法后旧数据仍可读取
+func (c *compressItemCodec) decompress(algorithm CompressAlgorithm, data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	src := bytes.NewReader(data)
+	switch algorithm {
+	case CompressGzip:
+		r, err = gzip.NewReader(src)
+	case CompressFlate:
+		r = flate.NewReader(src)
+	case CompressZlib:
+		r, err = zlib.NewReader(src)
+	default:
+		return nil, errors.ErrItemFormat
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v decompress failed, err=%v", errors.ErrItemCorrupt, algorithm, err)
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v decompress failed, err=%v", errors.ErrItemCorrupt, algorithm, err)
+	}
+	return out, nil
+}
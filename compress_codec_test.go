@@ -0,0 +1,60 @@
+package cached_caller
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/davidhacking/cached_caller/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressItemCodec(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"fid":1,"value":123}`), 50)
+	for _, algorithm := range []CompressAlgorithm{CompressGzip, CompressFlate, CompressZlib} {
+		mon := &countMonitor{counts: map[string]int{}}
+		codec, err := NewCompressItemCodec(nil, CompressConfig{Algorithm: algorithm, MinSize: 64}, mon)
+		assert.Nil(t, err)
+		_, value, err := codec.Encode(&Item{Key: "1", TS: 1, Data: data, SoftTTL: time.Second})
+		assert.Nil(t, err)
+		assert.True(t, len(value) < len(data)/5)
+		assert.Equal(t, len(data), mon.counts["itemCompressRawBytes"])
+		assert.True(t, mon.counts["itemCompressedBytes"] < len(data)/5)
+		item, err := codec.Decode("1", value)
+		assert.Nil(t, err)
+		assert.Equal(t, data, item.Data)
+		assert.Equal(t, int64(1), item.TS)
+		assert.Equal(t, time.Second, item.SoftTTL)
+
+		// 小于MinSize的数据不压缩
+		_, value, err = codec.Encode(&Item{Key: "2", TS: 1, Data: []byte("{}")})
+		assert.Nil(t, err)
+		assert.Equal(t, byte(CompressNone), value[1])
+		item, err = codec.Decode("2", value)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("{}"), item.Data)
+	}
+
+	// 开启压缩前写入的数据和其他算法写入的数据都可以解码
+	codec, err := NewCompressItemCodec(nil, DefaultCompressConfig(), nil)
+	assert.Nil(t, err)
+	_, value, err := (&defaultItemCodec{}).Encode(&Item{Key: "1", TS: 1, Data: data})
+	assert.Nil(t, err)
+	item, err := codec.Decode("1", value)
+	assert.Nil(t, err)
+	assert.Equal(t, data, item.Data)
+	zlibCodec, err := NewCompressItemCodec(nil, CompressConfig{Algorithm: CompressZlib}, nil)
+	assert.Nil(t, err)
+	_, value, err = zlibCodec.Encode(&Item{Key: "1", TS: 1, Data: data})
+	assert.Nil(t, err)
+	item, err = codec.Decode("1", value)
+	assert.Nil(t, err)
+	assert.Equal(t, data, item.Data)
+
+	value[1] = 0xff
+	_, err = codec.Decode("1", value)
+	assert.True(t, errors.Is(err, errors.ErrItemFormat))
+
+	_, err = NewCompressItemCodec(nil, CompressConfig{Algorithm: CompressAlgorithm(9)}, nil)
+	assert.NotNil(t, err)
+}
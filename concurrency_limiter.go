@@ -0,0 +1,144 @@
+package cached_caller
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// AIMDLimiterConfig 自适应并发限制配置
+type AIMDLimiterConfig struct {
+	InitLimit       int     // 初始并发限制
+	MinLimit        int     // 并发限制下限
+	MaxLimit        int     // 并发限制上限
+	BackoffRatio    float64 // 失败、超时或RTT明显变长时 limit = limit*BackoffRatio
+	RTTTolerance    float64 // RTT超过最小RTT的该倍数视为下游开始排队
+	MinRTTSampleNum int     // 每隔多少个样本重新统计最小RTT，适应下游的变化
+}
+
+// DefaultAIMDLimiterConfig 默认并发限制配置
+func DefaultAIMDLimiterConfig() AIMDLimiterConfig {
+	return AIMDLimiterConfig{
+		InitLimit:       20,
+		MinLimit:        5,
+		MaxLimit:        1000,
+		BackoffRatio:    0.9,
+		RTTTolerance:    2,
+		MinRTTSampleNum: 1000,
+	}
+}
+
+// aimdLimiter 加性增乘性减的并发限制：调用正常且并发限制被用满时每个RTT约增加1，
+// 失败、超时或RTT超过最小RTT的RTTTolerance倍时按BackoffRatio缩小，调用方取消的调用不影响并发限制
+type aimdLimiter struct {
+	lock          sync.Mutex
+	config        AIMDLimiterConfig
+	monitor       Monitor
+	limit         float64
+	inflight      int
+	minRTT        time.Duration
+	windowMinRTT  time.Duration
+	sampleNum     int
+	reportedLimit int
+}
+
+func (c AIMDLimiterConfig) validate() error {
+	if c.BackoffRatio <= 0 || c.BackoffRatio >= 1 {
+		return fmt.Errorf("invalid aimd limiter config: BackoffRatio=%v must be in (0, 1)", c.BackoffRatio)
+	}
+	if c.RTTTolerance < 1 {
+		return fmt.Errorf("invalid aimd limiter config: RTTTolerance=%v must be >= 1", c.RTTTolerance)
+	}
+	if c.MinRTTSampleNum < 0 {
+		return fmt.Errorf("invalid aimd limiter config: MinRTTSampleNum=%v must be >= 0", c.MinRTTSampleNum)
+	}
+	return nil
+}
+
+// NewAIMDLimiter 创建自适应并发限制，monitor为nil时使用CachedCaller的配置，config非法时返回错误
+func NewAIMDLimiter(config AIMDLimiterConfig, monitor Monitor) (ConcurrencyLimiter, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	if config.MinLimit <= 0 {
+		config.MinLimit = 1
+	}
+	if config.MaxLimit < config.MinLimit {
+		config.MaxLimit = config.MinLimit
+	}
+	limit := math.Max(float64(config.MinLimit), math.Min(float64(config.MaxLimit), float64(config.InitLimit)))
+	return &aimdLimiter{
+		config:  config,
+		monitor: monitor,
+		limit:   limit,
+	}, nil
+}
+
+func (a *aimdLimiter) setEnv(logger Logger, monitor Monitor) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.monitor == nil {
+		a.monitor = monitor
+	}
+}
+
+func (a *aimdLimiter) Acquire() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.inflight >= int(a.limit) {
+		return false
+	}
+	a.inflight++
+	return true
+}
+
+func (a *aimdLimiter) Release(t TransType, delta time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	inflight := a.inflight
+	a.inflight--
+	if t == TransTypeCanceled {
+		return
+	}
+	a.sampleRTT(delta)
+	queueing := a.minRTT > 0 && float64(delta) > float64(a.minRTT)*a.config.RTTTolerance
+	if t != TransTypeSuccess || queueing {
+		a.limit = math.Max(float64(a.config.MinLimit), a.limit*a.config.BackoffRatio)
+	} else if float64(inflight)*2 >= a.limit {
+		a.limit = math.Min(float64(a.config.MaxLimit), a.limit+1/a.limit)
+	}
+	a.report()
+}
+
+// Limit 当前并发限制
+func (a *aimdLimiter) Limit() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return int(a.limit)
+}
+
+func (a *aimdLimiter) sampleRTT(delta time.Duration) {
+	if a.windowMinRTT <= 0 || delta < a.windowMinRTT {
+		a.windowMinRTT = delta
+	}
+	if a.minRTT <= 0 || delta < a.minRTT {
+		a.minRTT = delta
+	}
+	a.sampleNum++
+	if a.config.MinRTTSampleNum > 0 && a.sampleNum >= a.config.MinRTTSampleNum {
+		a.minRTT = a.windowMinRTT
+		a.windowMinRTT = 0
+		a.sampleNum = 0
+	}
+}
+
+// report 以增量的方式上报当前并发限制，监控侧累加即为当前值
+func (a *aimdLimiter) report() {
+	if a.monitor == nil || int(a.limit) == a.reportedLimit {
+		return
+	}
+	a.monitor.Inc("concurrencyLimit", int(a.limit)-a.reportedLimit)
+	a.reportedLimit = int(a.limit)
+}
@@ -0,0 +1,90 @@
+package cached_caller
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAIMDLimiter(t *testing.T) {
+	mon := &countMonitor{counts: map[string]int{}}
+	config := DefaultAIMDLimiterConfig()
+	config.InitLimit = 4
+	config.MinLimit = 2
+	limiter, err := NewAIMDLimiter(config, mon)
+	assert.Nil(t, err)
+	l := limiter.(*aimdLimiter)
+	for i := 0; i < 4; i++ {
+		assert.True(t, l.Acquire())
+	}
+	assert.False(t, l.Acquire())
+	for i := 0; i < 4; i++ {
+		l.Release(TransTypeSuccess, 10*time.Millisecond)
+	}
+	assert.Equal(t, 4, l.Limit())
+
+	for i := 0; i < 20; i++ {
+		assert.True(t, l.Acquire())
+		assert.True(t, l.Acquire())
+		assert.True(t, l.Acquire())
+		l.Release(TransTypeSuccess, 10*time.Millisecond)
+		l.Release(TransTypeSuccess, 10*time.Millisecond)
+		l.Release(TransTypeSuccess, 10*time.Millisecond)
+	}
+	assert.True(t, l.Limit() > 4)
+
+	for i := 0; i < 20; i++ {
+		assert.True(t, l.Acquire())
+		l.Release(TransTypeSuccess, 100*time.Millisecond)
+	}
+	assert.Equal(t, 2, l.Limit())
+	assert.Equal(t, 2, mon.counts["concurrencyLimit"])
+}
+
+func TestAIMDLimiterInvalidConfig(t *testing.T) {
+	for _, modify := range []func(c *AIMDLimiterConfig){
+		func(c *AIMDLimiterConfig) { c.BackoffRatio = 0 },
+		func(c *AIMDLimiterConfig) { c.BackoffRatio = 1.5 },
+		func(c *AIMDLimiterConfig) { c.RTTTolerance = -1 },
+		func(c *AIMDLimiterConfig) { c.MinRTTSampleNum = -1 },
+	} {
+		config := DefaultAIMDLimiterConfig()
+		modify(&config)
+		_, err := NewAIMDLimiter(config, nil)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestConcurrencyLimitDegrade(t *testing.T) {
+	c := NewCachedCaller()
+	config := DefaultAIMDLimiterConfig()
+	config.MinLimit = 1
+	config.MaxLimit = 1
+	cc := &CountFeatureCaller{}
+	limiter, err := NewAIMDLimiter(config, nil)
+	assert.Nil(t, err)
+	err = c.Init(cc, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+		WithConcurrencyLimiter(limiter))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := c.Call(context.Background(), time.Second, &FeatureRequest{
+			itemInfos: []*ItemInfo{{ItemID: "111"}},
+		})
+		assert.Nil(t, err)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	rsp, err := c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "222"}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, rsp.(*FeatureResponse).itemInfos[0].Feature)
+	<-done
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cc.callCnt))
+}
@@ -0,0 +1,290 @@
+package cached_caller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig 配置文件格式，支持YAML和JSON，未配置的字段保持DefaultConfig的值，
+// 编解码器ReqCodec/RspCodec仍需通过代码传入。示例：
+//
+//	cache:
+//	  name: bigcache
+//	  params:
+//	    shards: 1024
+//	    life_window: 20m
+//	    hard_max_cache_size: 512
+//	background_updater:
+//	  name: default
+//	  params:
+//	    max_age: 10m
+//	background_update:
+//	  duration: 10m
+//	  timeout: 10s
+//	  batch_num: 100
+//	  parallel_num: 5
+//	trans_ctrl:
+//	  name: default
+//	  ctrl_window: 100000
+//	  err_threshold: 0.01
+//	  timeout_threshold: 0.01
+//	  err_degrade_rate: 2
+//	  timeout_degrade_rate: 2
+//	dump:
+//	  path: /data/cache.dump
+//	  interval: 5m
+//	warm_up:
+//	  path: /data/cache.dump
+//	  max_age: 1h
+//	  refresh_stale: true
+//	negative_cache_ttl: 1m
+//	stale_while_revalidate: 5m
+//	compress:
+//	  algorithm: gzip
+//	  level: 6
+//	  min_size: 256
+type FileConfig struct {
+	Cache                *PluginConfig           `json:"cache" yaml:"cache"`
+	BackgroundUpdater    *PluginConfig           `json:"background_updater" yaml:"background_updater"`
+	Monitor              *PluginConfig           `json:"monitor" yaml:"monitor"`
+	BackgroundUpdate     *BackgroundUpdateConfig `json:"background_update" yaml:"background_update"`
+	TransCtrl            *TransCtrlFileConfig    `json:"trans_ctrl" yaml:"trans_ctrl"`
+	Dump                 *DumpConfig             `json:"dump" yaml:"dump"`
+	WarmUp               *WarmUpConfig           `json:"warm_up" yaml:"warm_up"`
+	NegativeCacheTTL     Duration                `json:"negative_cache_ttl" yaml:"negative_cache_ttl"`
+	StaleWhileRevalidate Duration                `json:"stale_while_revalidate" yaml:"stale_while_revalidate"`
+	Compress             *CompressFileConfig     `json:"compress" yaml:"compress"`
+}
+
+// PluginConfig 通过Register*注册的插件名及其参数
+type PluginConfig struct {
+	Name   string       `json:"name" yaml:"name"`
+	Params PluginParams `json:"params" yaml:"params"`
+}
+
+// BackgroundUpdateConfig 后台更新配置
+type BackgroundUpdateConfig struct {
+	Duration    Duration `json:"duration" yaml:"duration"`
+	Timeout     Duration `json:"timeout" yaml:"timeout"`
+	BatchNum    int      `json:"batch_num" yaml:"batch_num"`
+	ParallelNum int      `json:"parallel_num" yaml:"parallel_num"`
+}
+
+// TransCtrlFileConfig 拥塞控制配置，未配置的阈值使用DefaultTransCtrlConfig
+type TransCtrlFileConfig struct {
+	Name               string       `json:"name" yaml:"name"`
+	Params             PluginParams `json:"params" yaml:"params"`
+	CtrlWindow         *int         `json:"ctrl_window" yaml:"ctrl_window"`
+	ErrThreshold       *float64     `json:"err_threshold" yaml:"err_threshold"`
+	TimeoutThreshold   *float64     `json:"timeout_threshold" yaml:"timeout_threshold"`
+	ErrDegradeRate     *float64     `json:"err_degrade_rate" yaml:"err_degrade_rate"`
+	TimeoutDegradeRate *float64     `json:"timeout_degrade_rate" yaml:"timeout_degrade_rate"`
+}
+
+// DumpConfig 缓存dump配置
+type DumpConfig struct {
+	Path     string   `json:"path" yaml:"path"`
+	Interval Duration `json:"interval" yaml:"interval"`
+}
+
+// WarmUpConfig 预热配置
+type WarmUpConfig struct {
+	Path         string   `json:"path" yaml:"path"`
+	MaxAge       Duration `json:"max_age" yaml:"max_age"`
+	RefreshStale bool     `json:"refresh_stale" yaml:"refresh_stale"`
+}
+
+// CompressFileConfig 使用压缩codec包装默认ItemCodec，未配置的字段使用DefaultCompressConfig的值
+type CompressFileConfig struct {
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+	Level     *int   `json:"level" yaml:"level"`
+	MinSize   *int   `json:"min_size" yaml:"min_size"`
+}
+
+// Duration 配置文件中的时长，格式同time.ParseDuration，例如"10m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\", err=%v", err)
+	}
+	return d.parse(str)
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var str string
+	err := value.Decode(&str)
+	if err != nil {
+		return err
+	}
+	return d.parse(str)
+}
+
+func (d *Duration) parse(str string) error {
+	v, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ConfigFromFile 读取YAML或JSON配置文件转为Option
+func ConfigFromFile(path string) ([]Option, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file failed, err=%v", err)
+	}
+	return OptionsFromReader(bytes.NewReader(data))
+}
+
+// OptionsFromReader 解析YAML或JSON配置转为Option，以'{'开头的内容按JSON解析
+func OptionsFromReader(reader io.Reader) ([]Option, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read config failed, err=%v", err)
+	}
+	fileConfig := &FileConfig{}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(fileConfig)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(fileConfig)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode config failed, err=%v", err)
+	}
+	return fileConfig.Options()
+}
+
+// Options 将配置转为Option，插件在此时创建
+func (f *FileConfig) Options() ([]Option, error) {
+	opts := make([]Option, 0)
+	if f.Cache != nil {
+		cache, err := newCacheByName(f.Cache.Name, f.Cache.Params)
+		if err != nil {
+			return nil, fmt.Errorf("create cache failed, err=%v", err)
+		}
+		opts = append(opts, WithCache(cache))
+	}
+	if f.BackgroundUpdater != nil {
+		updater, err := newBackgroundUpdaterByName(f.BackgroundUpdater.Name, f.BackgroundUpdater.Params)
+		if err != nil {
+			return nil, fmt.Errorf("create background updater failed, err=%v", err)
+		}
+		opts = append(opts, WithBackgroundUpdater(updater))
+	}
+	if f.Monitor != nil {
+		monitor, err := newMonitorByName(f.Monitor.Name, f.Monitor.Params)
+		if err != nil {
+			return nil, fmt.Errorf("create monitor failed, err=%v", err)
+		}
+		opts = append(opts, WithMonitor(monitor))
+	}
+	if u := f.BackgroundUpdate; u != nil {
+		if u.Duration > 0 {
+			opts = append(opts, WithBackgroundUpdateDuration(time.Duration(u.Duration)))
+		}
+		if u.Timeout > 0 {
+			opts = append(opts, WithBackgroundUpdateTimeout(time.Duration(u.Timeout)))
+		}
+		if u.BatchNum != 0 {
+			opts = append(opts, WithBackgroundUpdateBatchNum(u.BatchNum))
+		}
+		if u.ParallelNum != 0 {
+			opts = append(opts, WithBackgroundUpdateParallelNum(u.ParallelNum))
+		}
+	}
+	if f.TransCtrl != nil {
+		transCtrlOpts, err := f.TransCtrl.options()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, transCtrlOpts...)
+	}
+	if f.Dump != nil {
+		opts = append(opts, WithCacheDump(f.Dump.Path, time.Duration(f.Dump.Interval)))
+	}
+	if f.WarmUp != nil {
+		opts = append(opts, WithWarmUp(f.WarmUp.Path, time.Duration(f.WarmUp.MaxAge), f.WarmUp.RefreshStale))
+	}
+	if f.NegativeCacheTTL > 0 {
+		opts = append(opts, WithNegativeCache(time.Duration(f.NegativeCacheTTL)))
+	}
+	if f.StaleWhileRevalidate > 0 {
+		opts = append(opts, WithStaleWhileRevalidate(time.Duration(f.StaleWhileRevalidate)))
+	}
+	if f.Compress != nil {
+		codec, err := f.Compress.itemCodec()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithItemCodec(codec))
+	}
+	return opts, nil
+}
+
+func (t *TransCtrlFileConfig) options() ([]Option, error) {
+	opts := make([]Option, 0, 2)
+	if t.Name != "" {
+		transCtrl, err := newTransCtrlByName(t.Name, t.Params)
+		if err != nil {
+			return nil, fmt.Errorf("create trans ctrl failed, err=%v", err)
+		}
+		opts = append(opts, WithTransCtrl(transCtrl))
+	}
+	config := DefaultTransCtrlConfig()
+	if t.CtrlWindow != nil {
+		config.CtrlWindow = *t.CtrlWindow
+	}
+	if t.ErrThreshold != nil {
+		config.ErrThreshold = *t.ErrThreshold
+	}
+	if t.TimeoutThreshold != nil {
+		config.TimeoutThreshold = *t.TimeoutThreshold
+	}
+	if t.ErrDegradeRate != nil {
+		config.ErrDegradeRate = *t.ErrDegradeRate
+	}
+	if t.TimeoutDegradeRate != nil {
+		config.TimeoutDegradeRate = *t.TimeoutDegradeRate
+	}
+	return append(opts, WithTransCtrlConfig(config)), nil
+}
+
+func (c *CompressFileConfig) itemCodec() (ItemCodec, error) {
+	config := DefaultCompressConfig()
+	if c.Algorithm != "" {
+		algorithm, err := ParseCompressAlgorithm(c.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		config.Algorithm = algorithm
+	}
+	if c.Level != nil {
+		config.Level = *c.Level
+	}
+	if c.MinSize != nil {
+		config.MinSize = *c.MinSize
+	}
+	codec, err := NewCompressItemCodec(nil, config, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create compress codec failed, err=%v", err)
+	}
+	return codec, nil
+}
@@ -0,0 +1,98 @@
+package cached_caller
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countMonitor struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func (m *countMonitor) Inc(name string, n ...int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(n) > 0 {
+		m.counts[name] += n[0]
+		return
+	}
+	m.counts[name]++
+}
+
+func applyOptions(t *testing.T, opts []Option) *Config {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		assert.Nil(t, opt(cfg))
+	}
+	return cfg
+}
+
+func TestOptionsFromReader(t *testing.T) {
+	RegisterMonitor("count", func(params PluginParams) (Monitor, error) {
+		return &countMonitor{counts: map[string]int{}}, nil
+	})
+	yamlConfig := `
+cache:
+  name: bigcache
+  params:
+    shards: 64
+    life_window: 1m
+background_updater:
+  name: default
+  params:
+    max_age: 30s
+monitor:
+  name: count
+background_update:
+  duration: 1m
+  batch_num: 10
+trans_ctrl:
+  err_threshold: 0.2
+negative_cache_ttl: 30s
+stale_while_revalidate: 1m
+compress:
+  algorithm: zlib
+  min_size: 128
+`
+	jsonConfig := `{
+	"cache": {"name": "bigcache", "params": {"shards": 64, "life_window": "1m"}},
+	"background_updater": {"name": "default", "params": {"max_age": "30s"}},
+	"monitor": {"name": "count"},
+	"background_update": {"duration": "1m", "batch_num": 10},
+	"trans_ctrl": {"err_threshold": 0.2},
+	"negative_cache_ttl": "30s",
+	"stale_while_revalidate": "1m",
+	"compress": {"algorithm": "zlib", "min_size": 128}
+}`
+	for _, content := range []string{yamlConfig, jsonConfig} {
+		opts, err := OptionsFromReader(strings.NewReader(content))
+		assert.Nil(t, err)
+		cfg := applyOptions(t, opts)
+		assert.Equal(t, time.Minute, cfg.backgroundUpdateDuration)
+		assert.Equal(t, 10, cfg.backgroundUpdateBatchNum)
+		assert.Equal(t, 5, cfg.backgroundUpdateParallelNum)
+		assert.Equal(t, 0.2, cfg.transCtrlConfig.ErrThreshold)
+		assert.Equal(t, DefaultTransCtrlConfig().CtrlWindow, cfg.transCtrlConfig.CtrlWindow)
+		assert.Equal(t, 30*time.Second, cfg.negativeCacheTTL)
+		assert.Equal(t, time.Minute, cfg.staleWhileRevalidate)
+		assert.Equal(t, CompressZlib, cfg.itemCodec.(*compressItemCodec).config.Algorithm)
+		assert.Equal(t, 128, cfg.itemCodec.(*compressItemCodec).config.MinSize)
+		assert.Equal(t, 30*time.Second, cfg.backgroundUpdater.(*defaultBackgroundUpdater).maxAge)
+		_, ok := cfg.monitor.(*countMonitor)
+		assert.True(t, ok)
+		_, ok = cfg.cache.(*bigCacheDecorator)
+		assert.True(t, ok)
+	}
+
+	_, err := OptionsFromReader(strings.NewReader("cache:\n  name: unknown\n"))
+	assert.NotNil(t, err)
+	_, err = OptionsFromReader(strings.NewReader("background_update:\n  duration: 10\n"))
+	assert.NotNil(t, err)
+	_, err = OptionsFromReader(strings.NewReader("unknown_field: 1\n"))
+	assert.NotNil(t, err)
+}
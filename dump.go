@@ -0,0 +1,149 @@
+package cached_caller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/davidhacking/cached_caller/errors"
+)
+
+// dump文件格式：
+//
+//	header: magic(4) | version(1)
+//	entry:  tag(1)=dumpTagEntry | keyLen(4) | valueLen(4) | key | value | crc32(key+value)(4)
+//	footer: tag(1)=dumpTagEnd | entryNum(8)
+//
+// 所有整数均为大端序
+const (
+	dumpMagic        = "CCDP"
+	dumpVersion      = byte(1)
+	dumpTagEntry     = byte(1)
+	dumpTagEnd       = byte(0)
+	dumpMaxKeyLen    = 1 << 16
+	dumpMaxValueLen  = 1 << 30
+	dumpEntryHeadLen = 4 + 4
+)
+
+// dumpStats dump读写统计
+type dumpStats struct {
+	entries  int
+	corrupt  int
+	oversize int // 写入时key或value超过长度上限而跳过的entry
+}
+
+// writeDump 将iter遍历到的所有kv以dump格式写入writer，超过readDump长度上限的kv跳过，避免整个dump无法加载
+func writeDump(writer io.Writer, iter CacheIter) (stats dumpStats, err error) {
+	w := bufio.NewWriter(writer)
+	_, err = w.WriteString(dumpMagic)
+	if err != nil {
+		return stats, err
+	}
+	err = w.WriteByte(dumpVersion)
+	if err != nil {
+		return stats, err
+	}
+	head := make([]byte, dumpEntryHeadLen)
+	sum := make([]byte, 4)
+	for {
+		key, value, err := iter.Next()
+		if err == errors.ErrCacheIterStop {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("iter next failed, err=%v", err)
+		}
+		if len(key) > dumpMaxKeyLen || len(value) > dumpMaxValueLen {
+			stats.oversize++
+			continue
+		}
+		binary.BigEndian.PutUint32(head[0:4], uint32(len(key)))
+		binary.BigEndian.PutUint32(head[4:8], uint32(len(value)))
+		crc := crc32.NewIEEE()
+		_, _ = crc.Write([]byte(key))
+		_, _ = crc.Write(value)
+		binary.BigEndian.PutUint32(sum, crc.Sum32())
+		_ = w.WriteByte(dumpTagEntry)
+		_, _ = w.Write(head)
+		_, _ = w.WriteString(key)
+		_, _ = w.Write(value)
+		_, err = w.Write(sum)
+		if err != nil {
+			return stats, err
+		}
+		stats.entries++
+	}
+	footer := make([]byte, 9)
+	footer[0] = dumpTagEnd
+	binary.BigEndian.PutUint64(footer[1:], uint64(stats.entries))
+	_, err = w.Write(footer)
+	if err != nil {
+		return stats, err
+	}
+	return stats, w.Flush()
+}
+
+// readDump 流式读取dump，每个校验通过的kv回调fn，校验失败的entry跳过并计入corrupt
+func readDump(reader io.Reader, fn func(key string, value []byte) error) (stats dumpStats, err error) {
+	r := bufio.NewReader(reader)
+	header := make([]byte, len(dumpMagic)+1)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return stats, fmt.Errorf("read dump header failed, err=%v", err)
+	}
+	if !bytes.Equal(header[:len(dumpMagic)], []byte(dumpMagic)) {
+		return stats, errors.ErrDumpFormat
+	}
+	if header[len(dumpMagic)] != dumpVersion {
+		return stats, fmt.Errorf("unsupported dump version %v", header[len(dumpMagic)])
+	}
+	head := make([]byte, dumpEntryHeadLen)
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return stats, fmt.Errorf("read dump tag failed, err=%v", err)
+		}
+		if tag == dumpTagEnd {
+			break
+		}
+		if tag != dumpTagEntry {
+			return stats, errors.ErrDumpFormat
+		}
+		_, err = io.ReadFull(r, head)
+		if err != nil {
+			return stats, fmt.Errorf("read dump entry failed, err=%v", err)
+		}
+		keyLen := binary.BigEndian.Uint32(head[0:4])
+		valueLen := binary.BigEndian.Uint32(head[4:8])
+		if keyLen > dumpMaxKeyLen || valueLen > dumpMaxValueLen {
+			return stats, errors.ErrDumpFormat
+		}
+		buf := make([]byte, int(keyLen)+int(valueLen)+4)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return stats, fmt.Errorf("read dump entry failed, err=%v", err)
+		}
+		data := buf[:keyLen+valueLen]
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(buf[keyLen+valueLen:]) {
+			stats.corrupt++
+			continue
+		}
+		err = fn(string(data[:keyLen]), data[keyLen:])
+		if err != nil {
+			return stats, err
+		}
+		stats.entries++
+	}
+	footer := make([]byte, 8)
+	_, err = io.ReadFull(r, footer)
+	if err != nil {
+		return stats, fmt.Errorf("read dump footer failed, err=%v", err)
+	}
+	if int(binary.BigEndian.Uint64(footer)) != stats.entries+stats.corrupt {
+		return stats, errors.ErrDumpFormat
+	}
+	return stats, nil
+}
@@ -0,0 +1,181 @@
+package cached_caller
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidhacking/cached_caller/errors"
+	"github.com/davidhacking/cached_caller/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBigCacheDump(t *testing.T) {
+	cache := newTestCaching()
+	assert.Nil(t, cache.Put("111", []byte("v111")))
+	assert.Nil(t, cache.Put("222", []byte("v222")))
+	buf := &bytes.Buffer{}
+	assert.Nil(t, cache.(CacheDumpable).Dump(buf))
+	data := buf.Bytes()
+
+	cache2 := newTestCaching()
+	assert.Nil(t, cache2.(CacheDumpable).FromDump(bytes.NewReader(data)))
+	value, err := cache2.Get("222")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v222"), value)
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(dumpMagic)+1+1+dumpEntryHeadLen] ^= 0xff
+	cache3 := newTestCaching()
+	err = cache3.(CacheDumpable).FromDump(bytes.NewReader(corrupt))
+	assert.Equal(t, errors.ErrDumpCorrupt, err)
+	_, err1 := cache3.Get("111")
+	_, err2 := cache3.Get("222")
+	assert.True(t, (err1 == nil) != (err2 == nil))
+
+	err = cache3.(CacheDumpable).FromDump(bytes.NewReader(data[:len(data)-3]))
+	assert.NotNil(t, err)
+}
+
+type sliceCacheIter struct {
+	keys []string
+}
+
+func (s *sliceCacheIter) Next() (key string, value []byte, err error) {
+	if len(s.keys) <= 0 {
+		return "", nil, errors.ErrCacheIterStop
+	}
+	key, s.keys = s.keys[0], s.keys[1:]
+	return key, []byte("value"), nil
+}
+
+func TestWriteDumpOversize(t *testing.T) {
+	buf := &bytes.Buffer{}
+	iter := &sliceCacheIter{keys: []string{"111", strings.Repeat("k", dumpMaxKeyLen+1), "222"}}
+	stats, err := writeDump(buf, iter)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.entries)
+	assert.Equal(t, 1, stats.oversize)
+	var keys []string
+	stats, err = readDump(buf, func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"111", "222"}, keys)
+}
+
+func TestCacheDumpToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cached_caller")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.dump")
+	c := NewCachedCaller()
+	cache := newTestCaching()
+	err = c.Init(&VideoFeatureCaller{}, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}),
+		WithCache(cache), WithCacheDump(path, 500*time.Millisecond))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.Nil(t, err)
+	time.Sleep(time.Second)
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	cache2 := newTestCaching()
+	assert.Nil(t, cache2.(CacheDumpable).FromDump(f))
+	value, err := cache2.Get("111")
+	assert.Nil(t, err)
+	expect, err := cache.Get("111")
+	assert.Nil(t, err)
+	assert.Equal(t, expect, value)
+}
+
+func TestWarmUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cached_caller")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.dump")
+	src := newTestCaching()
+	codec := &defaultItemCodec{}
+	for id, age := range map[string]int64{"fresh": 0, "stale": 60, "old": 3600} {
+		data, err := (&ItemInfo{ItemID: id}).Marshal()
+		assert.Nil(t, err)
+		key, value, err := codec.Encode(&Item{Key: id, TS: utils.NowTS() - age, Data: data})
+		assert.Nil(t, err)
+		assert.Nil(t, src.Put(key, value))
+	}
+	assert.Nil(t, dumpToFile(src.(CacheDumpable), path))
+
+	c := NewCachedCaller()
+	vc3 := &VideoFeatureCaller3{}
+	cache := newTestCaching()
+	err = c.Init(vc3, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}),
+		WithCache(cache), WithBackgroundUpdater(&VideoBackgroundUpdater{}),
+		WithWarmUp(path, 10*time.Minute, true))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	_, err = cache.Get("fresh")
+	assert.Nil(t, err)
+	_, err = cache.Get("old")
+	assert.NotNil(t, err)
+	assert.Eventually(t, func() bool {
+		callCnt, _ := vc3.stats()
+		return callCnt == 1
+	}, time.Second, 10*time.Millisecond)
+	_, lastReq := vc3.stats()
+	assert.Equal(t, "stale", lastReq.itemInfos[0].ItemID)
+}
+
+func TestClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cached_caller")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.dump")
+	c := NewCachedCaller()
+	err = c.Init(&VideoFeatureCaller{}, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+		WithBackgroundUpdateDuration(time.Hour), WithCacheDump(path, time.Hour))
+	assert.Nil(t, err)
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "111"}},
+	})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, c.Close(ctx))
+	assert.Nil(t, c.Close(ctx))
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+
+	// Close等待超时调用的迟到结果写入缓存后再做最后一次dump
+	c = NewCachedCaller()
+	err = c.Init(&SlowFeatureCaller{sleep: 200 * time.Millisecond}, WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}), WithCache(newTestCaching()),
+		WithBackgroundUpdateDuration(time.Hour), WithCacheDump(path, time.Hour))
+	assert.Nil(t, err)
+	_, err = c.Call(context.Background(), 50*time.Millisecond, &FeatureRequest{
+		itemInfos: []*ItemInfo{{ItemID: "333"}},
+	})
+	assert.True(t, errors.Is(err, errors.ErrCallTimeout))
+	assert.Nil(t, c.Close(ctx))
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	var keys []string
+	_, err = readDump(file, func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"333"}, keys)
+}
@@ -0,0 +1,196 @@
+package cached_caller
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/davidhacking/cached_caller/errors"
+)
+
+// KeyProvider 加密密钥来源，同一个id对应的密钥不能改变，轮换时使用新id，
+// 旧id在使用它加密的数据过期（包括dump文件）之前需要保留
+type KeyProvider interface {
+	// CurrentKey 加密使用的密钥，长度为16、24或32字节，分别对应AES-128、AES-192、AES-256
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key 根据id获取解密使用的密钥
+	Key(id uint32) (key []byte, err error)
+}
+
+type staticKeyProvider struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewStaticKeyProvider 固定密钥集合，current为加密使用的密钥id
+func NewStaticKeyProvider(current uint32, keys map[uint32][]byte) (KeyProvider, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key id %v not in keys", current)
+	}
+	copied := make(map[uint32][]byte, len(keys))
+	for id, key := range keys {
+		_, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key id=%v, err=%v", id, err)
+		}
+		copied[id] = append([]byte(nil), key...)
+	}
+	return &staticKeyProvider{current: current, keys: copied}, nil
+}
+
+func (s *staticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return s.current, s.keys[s.current], nil
+}
+
+func (s *staticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key id %v not found", id)
+	}
+	return key, nil
+}
+
+// encryptMagic 加密codec编码结果的首字节，格式为:
+//
+//	magic(1) | keyID(4) | nonce(12) | AES-GCM(内层codec的编码结果) | tag(16)
+//
+// 缓存key作为AAD参与认证，value被挪到其他key下时解密失败
+const (
+	encryptMagic     = byte(0x83)
+	encryptHeaderLen = 1 + 4
+)
+
+// encryptItemCodec 使用AES-GCM加密内层codec的编码结果，缓存和dump文件中的value均为密文，缓存key不加密。
+// 同时使用压缩时应加密压缩codec的结果，密文无法压缩
+type encryptItemCodec struct {
+	codec    ItemCodec
+	provider KeyProvider
+	lock     sync.Mutex
+	monitor  Monitor
+	aeads    sync.Map // keyID -> cipher.AEAD
+}
+
+// NewEncryptItemCodec 创建加密codec，codec为nil时使用默认codec，monitor为nil时使用CachedCaller的配置。
+// 没有加密的value解码失败，开启加密前的缓存和dump数据不会被读取
+func NewEncryptItemCodec(codec ItemCodec, provider KeyProvider, monitor Monitor) (ItemCodec, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("key provider is nil")
+	}
+	if codec == nil {
+		codec = &defaultItemCodec{}
+	}
+	e := &encryptItemCodec{
+		codec:    codec,
+		provider: provider,
+		monitor:  monitor,
+	}
+	id, key, err := provider.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("get current key failed, err=%v", err)
+	}
+	_, err = e.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encryptItemCodec) setEnv(logger Logger, monitor Monitor) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.monitor == nil {
+		e.monitor = monitor
+	}
+	if inner, ok := e.codec.(envAware); ok {
+		inner.setEnv(logger, monitor)
+	}
+}
+
+func (e *encryptItemCodec) mon() Monitor {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.monitor == nil {
+		return &defaultMonitor{}
+	}
+	return e.monitor
+}
+
+// aead 同一个id的密钥不变，创建后缓存，key为nil时从provider获取
+func (e *encryptItemCodec) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	if v, ok := e.aeads.Load(id); ok {
+		return v.(cipher.AEAD), nil
+	}
+	if key == nil {
+		var err error
+		key, err = e.provider.Key(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key id=%v, err=%v", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key id=%v, err=%v", id, err)
+	}
+	e.aeads.Store(id, aead)
+	return aead, nil
+}
+
+func (e *encryptItemCodec) Encode(item *Item) (key string, value []byte, err error) {
+	key, plain, err := e.codec.Encode(item)
+	if err != nil {
+		return "", nil, err
+	}
+	id, k, err := e.provider.CurrentKey()
+	if err != nil {
+		return "", nil, fmt.Errorf("get current key failed, err=%v", err)
+	}
+	aead, err := e.aead(id, k)
+	if err != nil {
+		return "", nil, err
+	}
+	nonceLen := aead.NonceSize()
+	value = make([]byte, encryptHeaderLen+nonceLen, encryptHeaderLen+nonceLen+len(plain)+aead.Overhead())
+	value[0] = encryptMagic
+	binary.BigEndian.PutUint32(value[1:], id)
+	nonce := value[encryptHeaderLen:]
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", nil, fmt.Errorf("generate nonce failed, err=%v", err)
+	}
+	return key, aead.Seal(value, nonce, plain, []byte(key)), nil
+}
+
+func (e *encryptItemCodec) Decode(key string, value []byte) (item *Item, err error) {
+	if len(value) < encryptHeaderLen || value[0] != encryptMagic {
+		e.mon().Inc("itemDecryptFail")
+		return nil, errors.ErrItemFormat
+	}
+	id := binary.BigEndian.Uint32(value[1:])
+	aead, err := e.aead(id, nil)
+	if err != nil {
+		e.mon().Inc("itemDecryptFail")
+		return nil, fmt.Errorf("%w: key id=%v, err=%v", errors.ErrItemCorrupt, id, err)
+	}
+	nonceLen := aead.NonceSize()
+	if len(value) < encryptHeaderLen+nonceLen+aead.Overhead() {
+		e.mon().Inc("itemDecryptFail")
+		return nil, errors.ErrItemFormat
+	}
+	nonce := value[encryptHeaderLen : encryptHeaderLen+nonceLen]
+	plain, err := aead.Open(nil, nonce, value[encryptHeaderLen+nonceLen:], []byte(key))
+	if err != nil {
+		e.mon().Inc("itemDecryptFail")
+		return nil, errors.ErrItemCorrupt
+	}
+	if current, _, err := e.provider.CurrentKey(); err == nil && current != id {
+		e.mon().Inc("itemDecryptOldKey")
+	}
+	return e.codec.Decode(key, plain)
+}
@@ -0,0 +1,88 @@
+package cached_caller
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/davidhacking/cached_caller/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptItemCodec(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	provider, err := NewStaticKeyProvider(1, map[uint32][]byte{1: key1})
+	assert.Nil(t, err)
+	codec, err := NewEncryptItemCodec(nil, provider, nil)
+	assert.Nil(t, err)
+	data := []byte(`{"user":"secret"}`)
+	_, value, err := codec.Encode(&Item{Key: "1", TS: 1, Data: data, SoftTTL: time.Second})
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(value, data))
+	item, err := codec.Decode("1", value)
+	assert.Nil(t, err)
+	assert.Equal(t, data, item.Data)
+	assert.Equal(t, time.Second, item.SoftTTL)
+
+	// value挪到其他key下或被篡改时解密失败
+	_, err = codec.Decode("2", value)
+	assert.True(t, errors.Is(err, errors.ErrItemCorrupt))
+	tampered := append([]byte(nil), value...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = codec.Decode("1", tampered)
+	assert.True(t, errors.Is(err, errors.ErrItemCorrupt))
+	_, plain, err := (&defaultItemCodec{}).Encode(&Item{Key: "1", TS: 1, Data: data})
+	assert.Nil(t, err)
+	_, err = codec.Decode("1", plain)
+	assert.True(t, errors.Is(err, errors.ErrItemFormat))
+
+	// 轮换后旧密钥加密的数据仍可读取，移除旧密钥后读取失败
+	mon := &countMonitor{counts: map[string]int{}}
+	rotated, err := NewStaticKeyProvider(2, map[uint32][]byte{1: key1, 2: key2})
+	assert.Nil(t, err)
+	codec, err = NewEncryptItemCodec(nil, rotated, mon)
+	assert.Nil(t, err)
+	item, err = codec.Decode("1", value)
+	assert.Nil(t, err)
+	assert.Equal(t, data, item.Data)
+	assert.Equal(t, 1, mon.counts["itemDecryptOldKey"])
+	_, value2, err := codec.Encode(&Item{Key: "1", TS: 1, Data: data})
+	assert.Nil(t, err)
+	removed, err := NewStaticKeyProvider(2, map[uint32][]byte{2: key2})
+	assert.Nil(t, err)
+	codec, err = NewEncryptItemCodec(nil, removed, nil)
+	assert.Nil(t, err)
+	_, err = codec.Decode("1", value2)
+	assert.Nil(t, err)
+	_, err = codec.Decode("1", value)
+	assert.True(t, errors.Is(err, errors.ErrItemCorrupt))
+
+	_, err = NewStaticKeyProvider(1, map[uint32][]byte{1: []byte("short")})
+	assert.NotNil(t, err)
+}
+
+func TestEncryptItemCodecDump(t *testing.T) {
+	provider, err := NewStaticKeyProvider(1, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	assert.Nil(t, err)
+	codec, err := NewEncryptItemCodec(nil, provider, nil)
+	assert.Nil(t, err)
+	c := NewCachedCaller()
+	err = c.Init(&CountFeatureCaller{},
+		WithReqCodec(&FeatureReqCodec{}),
+		WithRspCodec(&FeatureRspCodec{}),
+		WithItemCodec(codec),
+		WithCache(newTestCaching()),
+	)
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	impl := c.(*cachedCallerImpl)
+	err = impl.setItemsToCache([]*Item{{Key: "111", TS: 1, Data: []byte(`{"user":"secret"}`)}})
+	assert.Nil(t, err)
+	buf := &bytes.Buffer{}
+	err = impl.cfg().cache.(CacheDumpable).Dump(buf)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(buf.Bytes(), []byte("111")))
+	assert.False(t, bytes.Contains(buf.Bytes(), []byte("secret")))
+}
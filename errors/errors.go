@@ -1,10 +1,75 @@
 package errors
 
 import (
+	"errors"
 	"fmt"
 )
 
 var (
 	// ErrCacheIterStop 缓存遍历终止
 	ErrCacheIterStop = fmt.Errorf("cache iter stop")
+	// ErrCallTimeout 下游调用超时
+	ErrCallTimeout = fmt.Errorf("call timeout")
+	// ErrConcurrencyLimit 下游在途调用数超过并发限制
+	ErrConcurrencyLimit = fmt.Errorf("concurrency limit exceeded")
+	// ErrRateLimit 下游调用超过QPS限制
+	ErrRateLimit = fmt.Errorf("rate limit exceeded")
+	// ErrDumpFormat dump文件格式错误或被截断
+	ErrDumpFormat = fmt.Errorf("invalid dump format")
+	// ErrDumpCorrupt dump文件中存在校验失败的entry
+	ErrDumpCorrupt = fmt.Errorf("dump has corrupt entries")
+	// ErrItemFormat 缓存item版本未知或被截断
+	ErrItemFormat = fmt.Errorf("invalid item format")
+	// ErrItemCorrupt 缓存item校验失败
+	ErrItemCorrupt = fmt.Errorf("item checksum mismatch")
+	// ErrSchemaMismatch Item.Data的schema与当前的记录类型不一致
+	ErrSchemaMismatch = fmt.Errorf("value schema mismatch")
 )
+
+// 以下为CallError的错误类型，通过errors.Is判断
+var (
+	// ErrEncode 请求、回包或缓存item编解码失败
+	ErrEncode = fmt.Errorf("encode failed")
+	// ErrCache 读写缓存失败
+	ErrCache = fmt.Errorf("cache failed")
+	// ErrDegraded 降级且没有缓存可用
+	ErrDegraded = fmt.Errorf("degraded")
+	// ErrDownstream 下游调用失败且没有缓存数据可返回
+	ErrDownstream = fmt.Errorf("downstream failed")
+	// ErrPartialResult 下游调用失败或超时，返回的Rsp只包含缓存中已有的数据，原因可通过Unwrap获取
+	ErrPartialResult = fmt.Errorf("partial result")
+)
+
+// CallError 调用失败的详细信息，Kind为错误类型，Err为原始错误
+type CallError struct {
+	Kind error
+	Op   string
+	Err  error
+}
+
+// Wrap 包装原始错误，Kind为ErrEncode等错误类型
+func Wrap(kind error, op string, err error) error {
+	return &CallError{Kind: kind, Op: op, Err: err}
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("%v: %v failed, err=%v", e.Kind, e.Op, e.Err)
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CallError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Is 同标准库errors.Is，避免与标准库重名导致同时引入
+func Is(err, target error) bool {
+	return errors.Is(err, target)
+}
+
+// As 同标准库errors.As
+func As(err error, target interface{}) bool {
+	return errors.As(err, target)
+}
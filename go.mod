@@ -1,9 +1,15 @@
 module github.com/davidhacking/cached_caller
 
-go 1.14
+go 1.18
 
 require (
 	github.com/allegro/bigcache/v3 v3.0.2
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/stretchr/testify v1.7.0
+	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 )
@@ -0,0 +1,69 @@
+package cached_caller
+
+import (
+	"sync"
+)
+
+// flight 某个key正在进行中的下游请求，done关闭后item为结果，请求失败时item为nil
+type flight struct {
+	done chan struct{}
+	item *Item
+}
+
+// inflightGroup 按key合并并发的下游请求
+type inflightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newInflightGroup() *inflightGroup {
+	return &inflightGroup{flights: make(map[string]*flight)}
+}
+
+// claim 认领idx对应item的key，返回本次认领到的下标；已有请求在途的key返回对应flight用于等待
+func (g *inflightGroup) claim(items []*Item, idx []int) (own []int, waits map[int]*flight) {
+	own = make([]int, 0, len(idx))
+	waits = make(map[int]*flight)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, i := range idx {
+		key := items[i].Key
+		if f, ok := g.flights[key]; ok {
+			waits[i] = f
+			continue
+		}
+		g.flights[key] = &flight{done: make(chan struct{})}
+		own = append(own, i)
+	}
+	return own, waits
+}
+
+// release 释放keys并把results中对应的item通知给等待方
+func (g *inflightGroup) release(keys []string, results []*Item) {
+	m := make(map[string]*Item, len(results))
+	for _, item := range results {
+		if !item.Resolved() {
+			continue
+		}
+		m[item.Key] = item
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range keys {
+		f, ok := g.flights[key]
+		if !ok {
+			continue
+		}
+		delete(g.flights, key)
+		f.item = m[key]
+		close(f.done)
+	}
+}
+
+func itemKeys(items []*Item) []string {
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	return keys
+}
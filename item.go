@@ -1,11 +1,47 @@
 package cached_caller
 
+import (
+	"time"
+
+	"github.com/davidhacking/cached_caller/utils"
+)
+
 type Item struct {
 	TS   int64
 	Key  string
 	Data []byte
+	// Absent 下游确认不存在该key，开启负缓存时写入缓存，避免重复调用下游
+	Absent bool
+	// SoftTTL 写入缓存超过SoftTTL后需要调用下游刷新，刷新失败时仍可返回，为0时不限制
+	SoftTTL time.Duration
+	// HardTTL 写入缓存超过HardTTL后不再返回，为0时不限制
+	HardTTL time.Duration
 }
 
 func (i *Item) Empty() bool {
 	return len(i.Data) == 0
 }
+
+// Resolved 有数据或确认不存在，不需要再调用下游
+func (i *Item) Resolved() bool {
+	return !i.Empty() || i.Absent
+}
+
+// Age 根据TS计算写入缓存后经过的时间
+func (i *Item) Age() time.Duration {
+	now := utils.NowTS()
+	if i.TS <= 0 || now <= i.TS {
+		return 0
+	}
+	return time.Duration(now-i.TS) * time.Second
+}
+
+// SoftExpired 超过SoftTTL
+func (i *Item) SoftExpired() bool {
+	return i.SoftTTL > 0 && i.Age() >= i.SoftTTL
+}
+
+// HardExpired 超过HardTTL
+func (i *Item) HardExpired() bool {
+	return i.HardTTL > 0 && i.Age() >= i.HardTTL
+}
@@ -1,32 +1,127 @@
 package cached_caller
 
 import (
-	"bytes"
 	"encoding/binary"
+	"hash/crc32"
+	"time"
+
+	"github.com/davidhacking/cached_caller/errors"
+)
+
+// defaultItemCodec 编码格式:
+//
+//	v1:     version(1)=itemCodecVersion1 | flags(1) | TS(8) | dataLen(4) | data | [SoftTTL(8) | HardTTL(8)] | crc32(4)
+//	legacy: TS(8) | dataLen(4) | data | [flags(1) | [SoftTTL(8) | HardTTL(8)]]
+//
+// legacy格式首字节为TS的最高字节，正常TS下恒为0，因此首字节为itemCodecVersion1时按v1解码，否则按legacy解码，
+// legacy数据在下一次写缓存时被重新编码为v1
+const (
+	itemCodecVersion1 = byte(0x81)
+	itemHeaderLen     = 1 + 1 + 8 + 4
+	itemTTLLen        = 8 + 8
+	itemChecksumLen   = 4
+)
+
+// Data之后的可选flags字节，没有flags的旧数据按有数据、不过期解码
+const (
+	itemFlagAbsent = byte(1)
+	// itemFlagTTL flags之后依次为SoftTTL和HardTTL，各8字节
+	itemFlagTTL = byte(2)
 )
 
 type defaultItemCodec struct {
 }
 
 func (i *defaultItemCodec) Encode(item *Item) (key string, value []byte, err error) {
-	length := 8 + 4 + len(item.Data)
-	value = make([]byte, length, length)
-	buf := bytes.NewBuffer(value[:0])
-	var uint32Buff = make([]byte, 4)
-	var uint64Buff = make([]byte, 8)
-	binary.BigEndian.PutUint64(uint64Buff, uint64(item.TS))
-	buf.Write(uint64Buff)
-	binary.BigEndian.PutUint32(uint32Buff, uint32(len(item.Data)))
-	buf.Write(uint32Buff)
-	buf.Write(item.Data)
+	flags := byte(0)
+	length := itemHeaderLen + len(item.Data) + itemChecksumLen
+	if item.Absent {
+		flags |= itemFlagAbsent
+	}
+	if item.SoftTTL > 0 || item.HardTTL > 0 {
+		flags |= itemFlagTTL
+		length += itemTTLLen
+	}
+	value = make([]byte, length)
+	value[0] = itemCodecVersion1
+	value[1] = flags
+	binary.BigEndian.PutUint64(value[2:], uint64(item.TS))
+	binary.BigEndian.PutUint32(value[10:], uint32(len(item.Data)))
+	off := itemHeaderLen + copy(value[itemHeaderLen:], item.Data)
+	if flags&itemFlagTTL != 0 {
+		binary.BigEndian.PutUint64(value[off:], uint64(item.SoftTTL))
+		binary.BigEndian.PutUint64(value[off+8:], uint64(item.HardTTL))
+		off += itemTTLLen
+	}
+	binary.BigEndian.PutUint32(value[off:], crc32.ChecksumIEEE(value[:off]))
 	return item.Key, value, nil
 }
 
 func (i *defaultItemCodec) Decode(key string, value []byte) (item *Item, err error) {
-	item = &Item{}
-	buf := bytes.NewBuffer(value)
-	item.Key = key
-	item.TS = int64(binary.BigEndian.Uint64(buf.Next(8)))
-	item.Data = buf.Next(int(binary.BigEndian.Uint32(buf.Next(4))))
+	if len(value) > 0 && value[0] == itemCodecVersion1 {
+		return decodeItemV1(key, value)
+	}
+	return decodeItemLegacy(key, value)
+}
+
+// decodeItemV1 校验crc32后解码，长度与flags不一致时返回ErrItemFormat
+func decodeItemV1(key string, value []byte) (*Item, error) {
+	if len(value) < itemHeaderLen+itemChecksumLen {
+		return nil, errors.ErrItemFormat
+	}
+	body := value[:len(value)-itemChecksumLen]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(value[len(body):]) {
+		return nil, errors.ErrItemCorrupt
+	}
+	flags := body[1]
+	dataLen := int(binary.BigEndian.Uint32(body[10:]))
+	expected := itemHeaderLen + dataLen
+	if flags&itemFlagTTL != 0 {
+		expected += itemTTLLen
+	}
+	if dataLen > len(body) || expected != len(body) {
+		return nil, errors.ErrItemFormat
+	}
+	item := &Item{
+		Key:    key,
+		TS:     int64(binary.BigEndian.Uint64(body[2:])),
+		Data:   body[itemHeaderLen : itemHeaderLen+dataLen],
+		Absent: flags&itemFlagAbsent != 0,
+	}
+	if flags&itemFlagTTL != 0 {
+		off := itemHeaderLen + dataLen
+		item.SoftTTL = time.Duration(binary.BigEndian.Uint64(body[off:]))
+		item.HardTTL = time.Duration(binary.BigEndian.Uint64(body[off+8:]))
+	}
+	return item, nil
+}
+
+// decodeItemLegacy 解码没有版本号和校验的旧格式，被截断时返回ErrItemFormat
+func decodeItemLegacy(key string, value []byte) (*Item, error) {
+	if len(value) < 8+4 {
+		return nil, errors.ErrItemFormat
+	}
+	dataLen := int(binary.BigEndian.Uint32(value[8:]))
+	if dataLen > len(value)-8-4 {
+		return nil, errors.ErrItemFormat
+	}
+	item := &Item{
+		Key:  key,
+		TS:   int64(binary.BigEndian.Uint64(value)),
+		Data: value[8+4 : 8+4+dataLen],
+	}
+	rest := value[8+4+dataLen:]
+	if len(rest) == 0 {
+		return item, nil
+	}
+	flags := rest[0]
+	item.Absent = flags&itemFlagAbsent != 0
+	if flags&itemFlagTTL != 0 {
+		if len(rest) < 1+itemTTLLen {
+			return nil, errors.ErrItemFormat
+		}
+		item.SoftTTL = time.Duration(binary.BigEndian.Uint64(rest[1:]))
+		item.HardTTL = time.Duration(binary.BigEndian.Uint64(rest[9:]))
+	}
 	return item, nil
 }
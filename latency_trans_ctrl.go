@@ -0,0 +1,178 @@
+package cached_caller
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	latencyHistogramBase   = 100 * time.Microsecond
+	latencyHistogramFactor = 1.1
+	latencyHistogramSize   = 150 // 覆盖100us到约2.2小时
+)
+
+// LatencyCtrlConfig 基于耗时分位数的降级配置
+type LatencyCtrlConfig struct {
+	Window         time.Duration // 统计窗口，分位数基于上一个窗口和当前窗口计算
+	Percentile     float64       // 关注的分位数，例如0.99
+	MinSampleNum   int           // 样本数低于该值时不降级
+	DegradeStart   float64       // 分位耗时/超时时间超过该比例开始降级，例如0.6
+	MaxDegradeRate float64       // 分位耗时达到超时时间时的降级比例，中间线性增长
+}
+
+// DefaultLatencyCtrlConfig p99达到超时的60%开始降级，达到超时时降级90%
+func DefaultLatencyCtrlConfig() LatencyCtrlConfig {
+	return LatencyCtrlConfig{
+		Window:         10 * time.Second,
+		Percentile:     0.99,
+		MinSampleNum:   100,
+		DegradeStart:   0.6,
+		MaxDegradeRate: 0.9,
+	}
+}
+
+type latencyHistogram [latencyHistogramSize]int
+
+func latencyBucket(delta time.Duration) int {
+	if delta <= latencyHistogramBase {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(delta)/float64(latencyHistogramBase)) / math.Log(latencyHistogramFactor)))
+	if i >= latencyHistogramSize {
+		return latencyHistogramSize - 1
+	}
+	return i
+}
+
+// latencyBucketUpper 桶的耗时上界
+func latencyBucketUpper(i int) time.Duration {
+	return time.Duration(float64(latencyHistogramBase) * math.Pow(latencyHistogramFactor, float64(i)))
+}
+
+// latencyTransCtrl 分位耗时逼近超时时间时按比例降级，在耗时恶化成超时之前保护下游；
+// 降级比例超过2个窗口没有更新时视为过期，避免全部降级后没有新样本而无法恢复
+type latencyTransCtrl struct {
+	lock        sync.Mutex
+	config      LatencyCtrlConfig
+	monitor     Monitor
+	now         func() time.Time
+	windowStart time.Time
+	prev        latencyHistogram
+	cur         latencyHistogram
+	degradeRate uint64 // float64 bits
+	rateAt      int64  // degradeRate的计算时间，UnixNano
+}
+
+// NewLatencyTransCtrl 创建基于耗时分位数的TransCtrl，monitor为nil时使用CachedCaller的配置
+func NewLatencyTransCtrl(config LatencyCtrlConfig, monitor Monitor) TransCtrl {
+	return &latencyTransCtrl{
+		config:  config,
+		monitor: monitor,
+		now:     time.Now,
+	}
+}
+
+func (l *latencyTransCtrl) setEnv(logger Logger, monitor Monitor) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.monitor == nil {
+		l.monitor = monitor
+	}
+}
+
+// Init 只使用LatencyCtrlConfig，TransCtrlConfig中的失败率配置不生效
+func (l *latencyTransCtrl) Init(config TransCtrlConfig) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	c := l.config
+	if c.Window <= 0 || c.Percentile <= 0 || c.Percentile > 1 {
+		return fmt.Errorf("invalid latency ctrl config: Window=%v must be > 0, Percentile=%v must be in (0, 1]",
+			c.Window, c.Percentile)
+	}
+	if c.DegradeStart < 0 || c.DegradeStart >= 1 || c.MaxDegradeRate < 0 || c.MaxDegradeRate > 1 {
+		return fmt.Errorf("invalid latency ctrl config: DegradeStart=%v must be in [0, 1), "+
+			"MaxDegradeRate=%v must be in [0, 1]", c.DegradeStart, c.MaxDegradeRate)
+	}
+	if l.monitor == nil {
+		l.monitor = &defaultMonitor{}
+	}
+	l.windowStart = l.now()
+	return nil
+}
+
+// Report 没有耗时信息，不影响降级
+func (l *latencyTransCtrl) Report(t TransType) {
+}
+
+func (l *latencyTransCtrl) ReportLatency(t TransType, delta time.Duration, timeout time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	if elapsed := now.Sub(l.windowStart); elapsed >= l.config.Window {
+		l.prev = l.cur
+		if elapsed >= 2*l.config.Window {
+			l.prev = latencyHistogram{}
+		}
+		l.cur = latencyHistogram{}
+		l.windowStart = now
+	}
+	l.cur[latencyBucket(delta)]++
+	if timeout <= 0 {
+		return
+	}
+	rate := 0.0
+	p, ok := l.percentile()
+	if ok {
+		ratio := float64(p) / float64(timeout)
+		rate = (ratio - l.config.DegradeStart) / (1 - l.config.DegradeStart)
+		rate = math.Max(0, math.Min(1, rate)) * l.config.MaxDegradeRate
+	}
+	atomic.StoreUint64(&l.degradeRate, math.Float64bits(rate))
+	atomic.StoreInt64(&l.rateAt, now.UnixNano())
+}
+
+// percentile 上一个窗口和当前窗口合并的分位耗时，样本不足时返回false
+func (l *latencyTransCtrl) percentile() (time.Duration, bool) {
+	total := 0
+	for i := range l.cur {
+		total += l.cur[i] + l.prev[i]
+	}
+	if total <= 0 || total < l.config.MinSampleNum {
+		return 0, false
+	}
+	target := int(math.Ceil(float64(total) * l.config.Percentile))
+	count := 0
+	for i := range l.cur {
+		count += l.cur[i] + l.prev[i]
+		if count >= target {
+			return latencyBucketUpper(i), true
+		}
+	}
+	return latencyBucketUpper(latencyHistogramSize - 1), true
+}
+
+// DegradeRate 当前降级比例，过期时为0
+func (l *latencyTransCtrl) DegradeRate() float64 {
+	if l.now().Sub(time.Unix(0, atomic.LoadInt64(&l.rateAt))) >= 2*l.config.Window {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&l.degradeRate))
+}
+
+// Degrading 降级比例大于0
+func (l *latencyTransCtrl) Degrading() bool {
+	return l.DegradeRate() > 0
+}
+
+func (l *latencyTransCtrl) Degrade() bool {
+	rate := l.DegradeRate()
+	if rate <= 0 || rand.Float64() >= rate {
+		return false
+	}
+	l.monitor.Inc("latencyDegrade")
+	return true
+}
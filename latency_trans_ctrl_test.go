@@ -0,0 +1,87 @@
+package cached_caller
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyTransCtrl(t *testing.T) {
+	now := time.Unix(1000, 0)
+	config := DefaultLatencyCtrlConfig()
+	config.MinSampleNum = 10
+	l := NewLatencyTransCtrl(config, nil).(*latencyTransCtrl)
+	l.now = func() time.Time { return now }
+	assert.Nil(t, l.Init(DefaultTransCtrlConfig()))
+	timeout := 100 * time.Millisecond
+	for i := 0; i < 20; i++ {
+		l.ReportLatency(TransTypeSuccess, 10*time.Millisecond, timeout)
+	}
+	assert.Equal(t, 0.0, l.DegradeRate())
+	assert.False(t, l.Degrade())
+
+	for i := 0; i < 100; i++ {
+		l.ReportLatency(TransTypeSuccess, 90*time.Millisecond, timeout)
+	}
+	assert.True(t, l.DegradeRate() > 0.5)
+	degradeNum := 0
+	for i := 0; i < 1000; i++ {
+		if l.Degrade() {
+			degradeNum++
+		}
+	}
+	assert.True(t, degradeNum > 300)
+
+	now = now.Add(2 * config.Window)
+	l.ReportLatency(TransTypeSuccess, 10*time.Millisecond, timeout)
+	assert.Equal(t, 0.0, l.DegradeRate())
+
+	// 全部降级后没有新样本，降级比例过期后恢复调用下游
+	config.MaxDegradeRate = 1
+	l = NewLatencyTransCtrl(config, nil).(*latencyTransCtrl)
+	l.now = func() time.Time { return now }
+	assert.Nil(t, l.Init(DefaultTransCtrlConfig()))
+	for i := 0; i < 20; i++ {
+		l.ReportLatency(TransTypeSuccess, timeout, timeout)
+	}
+	assert.Equal(t, 1.0, l.DegradeRate())
+	assert.True(t, l.Degrade())
+	now = now.Add(time.Hour)
+	assert.Equal(t, 0.0, l.DegradeRate())
+	for i := 0; i < 1000; i++ {
+		assert.False(t, l.Degrade())
+	}
+}
+
+type recordLatencyTransCtrl struct {
+	noDegradeTransCtrl
+	reports   int32
+	latencies int32
+}
+
+func (r *recordLatencyTransCtrl) Report(t TransType) {
+	atomic.AddInt32(&r.reports, 1)
+}
+
+func (r *recordLatencyTransCtrl) ReportLatency(t TransType, delta time.Duration, timeout time.Duration) {
+	atomic.AddInt32(&r.latencies, 1)
+}
+
+func TestLatencyReportForegroundOnly(t *testing.T) {
+	ctrl := &recordLatencyTransCtrl{}
+	c := NewCachedCaller()
+	err := c.Init(&VideoFeatureCaller3{}, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()), WithTransCtrl(ctrl))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	_, err = c.Call(context.Background(), time.Second, &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "111"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ctrl.latencies))
+
+	c.(*cachedCallerImpl).updateCache([]*Item{{Key: "111"}})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ctrl.latencies))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ctrl.reports))
+}
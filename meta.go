@@ -0,0 +1,102 @@
+package cached_caller
+
+// itemMetas 与items下标一一对应的元信息，为nil时不记录
+type itemMetas struct {
+	metas []*ItemMeta
+	// cached 查询缓存后的item，下游调用后item未被替换说明下游没有返回新数据
+	cached []*Item
+}
+
+// newItemMetas 根据缓存查询结果初始化，需在items被更新TS之前调用
+func newItemMetas(items []*Item, meta CallMeta) *itemMetas {
+	if meta == nil {
+		return nil
+	}
+	m := &itemMetas{
+		metas:  make([]*ItemMeta, len(items)),
+		cached: make([]*Item, len(items)),
+	}
+	copy(m.cached, items)
+	for i, item := range items {
+		im := &ItemMeta{}
+		if item.Resolved() {
+			im.Source = ItemSourceCache
+			im.Absent = item.Absent
+			im.Age = item.Age()
+		}
+		m.metas[i] = im
+	}
+	return m
+}
+
+// degrade 降级时命中缓存的item标记为降级数据，需要调用下游的item标记为被降级
+func (m *itemMetas) degrade(missIdx []int) {
+	if m == nil {
+		return
+	}
+	for _, meta := range m.metas {
+		if meta.Source == ItemSourceCache {
+			meta.Source = ItemSourceDegraded
+		}
+	}
+	for _, idx := range missIdx {
+		m.metas[idx].Degraded = true
+	}
+}
+
+// downstreamFailed 下游调用失败，需要调用下游的item标记为失败
+func (m *itemMetas) downstreamFailed(missIdx []int) {
+	if m == nil {
+		return
+	}
+	for _, idx := range missIdx {
+		m.metas[idx].DownstreamFailed = true
+	}
+}
+
+// fromDownstream 下游返回了新数据的item标记为来自下游
+func (m *itemMetas) fromDownstream(items []*Item, idxs []int) {
+	if m == nil {
+		return
+	}
+	for _, idx := range idxs {
+		if items[idx] == m.cached[idx] || !items[idx].Resolved() {
+			continue
+		}
+		m.setDownstream(idx, items[idx])
+	}
+}
+
+// fromInflight 合并同key在途调用的item，只有已合并到items的才来自下游，等待超时或在途调用失败时标记为失败
+func (m *itemMetas) fromInflight(items []*Item, waits map[int]*flight) {
+	if m == nil {
+		return
+	}
+	for idx, f := range waits {
+		select {
+		case <-f.done:
+			if f.item != nil && items[idx] == f.item {
+				m.setDownstream(idx, items[idx])
+				continue
+			}
+		default:
+		}
+		m.metas[idx].DownstreamFailed = true
+	}
+}
+
+func (m *itemMetas) setDownstream(idx int, item *Item) {
+	m.metas[idx].Source = ItemSourceDownstream
+	m.metas[idx].Absent = item.Absent
+	m.metas[idx].Age = 0
+}
+
+// fill 以item key为索引写入meta
+func (m *itemMetas) fill(items []*Item, meta CallMeta) {
+	if m == nil {
+		return
+	}
+	for i, item := range items {
+		meta[item.Key] = m.metas[i]
+	}
+}
@@ -1,6 +1,7 @@
 package cached_caller
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -8,8 +9,13 @@ type Config struct {
 	reqCodec                    ReqCodec
 	rspCodec                    RspCodec
 	itemCodec                   ItemCodec
+	cacheDumpPath               string
 	cacheDumpDuration           time.Duration
+	warmUpPath                  string
+	warmUpMaxAge                time.Duration
+	warmUpRefreshStale          bool
 	cache                       Caching
+	defaultCache                bool // 未设置cache，Init成功时才创建默认bigcache
 	backgroundUpdater           BackgroundUpdater
 	backgroundUpdateBatchNum    int
 	backgroundUpdateParallelNum int
@@ -18,29 +24,39 @@ type Config struct {
 	monitor                     Monitor
 	transCtrl                   TransCtrl
 	transCtrlConfig             TransCtrlConfig
+	concurrencyLimiter          ConcurrencyLimiter
+	rateLimiter                 RateLimiter
+	negativeCacheTTL            time.Duration
+	staleWhileRevalidate        time.Duration
 	logger                      Logger
 }
 
 type TransCtrlConfig struct {
-	ctrlWindow         int // 控制窗口大小
-	errThreshold       float64
-	timeoutThreshold   float64
-	errDegradeRate     float64 // 例如失败率为0.1则 失败降级率 = errDegradeRate*0.1
-	timeoutDegradeRate float64 // 整体降级率为 失败降级率+超时降级率
+	CtrlWindow         int     // 控制窗口大小
+	ErrThreshold       float64 // 失败率阈值，取值0~1
+	TimeoutThreshold   float64 // 超时率阈值，取值0~1
+	ErrDegradeRate     float64 // 例如失败率为0.1则 失败降级率 = errDegradeRate*0.1
+	TimeoutDegradeRate float64 // 整体降级率为 失败降级率+超时降级率
+}
+
+// DefaultTransCtrlConfig 默认拥塞控制配置
+func DefaultTransCtrlConfig() TransCtrlConfig {
+	return TransCtrlConfig{
+		CtrlWindow:         1e5,
+		ErrThreshold:       0.01,
+		TimeoutThreshold:   0.01,
+		ErrDegradeRate:     2,
+		TimeoutDegradeRate: 2,
+	}
 }
 
 func DefaultConfig() *Config {
 	transCtrl := &defaultTransCtrl{}
-	_ = transCtrl.Init(TransCtrlConfig{
-		ctrlWindow:         1e5,
-		errThreshold:       0.01,
-		timeoutThreshold:   0.01,
-		errDegradeRate:     2,
-		timeoutDegradeRate: 2,
-	})
+	transCtrlConfig := DefaultTransCtrlConfig()
+	_ = transCtrl.Init(transCtrlConfig)
 	return &Config{
 		itemCodec:                   &defaultItemCodec{},
-		cache:                       NewBigCaching(),
+		defaultCache:                true,
 		backgroundUpdater:           &defaultBackgroundUpdater{},
 		backgroundUpdateBatchNum:    100,
 		backgroundUpdateParallelNum: 5,
@@ -48,10 +64,99 @@ func DefaultConfig() *Config {
 		backgroundUpdateDuration:    10 * time.Minute,
 		monitor:                     &defaultMonitor{},
 		transCtrl:                   transCtrl,
+		transCtrlConfig:             transCtrlConfig,
 		logger:                      &defaultLogger{},
 	}
 }
 
+// validate Init时检查配置，避免在调用时才panic
+func (cfg *Config) validate() error {
+	if cfg.reqCodec == nil {
+		return fmt.Errorf("invalid config: reqCodec is nil, use WithReqCodec")
+	}
+	if cfg.rspCodec == nil {
+		return fmt.Errorf("invalid config: rspCodec is nil, use WithRspCodec")
+	}
+	if cfg.itemCodec == nil {
+		return fmt.Errorf("invalid config: itemCodec is nil")
+	}
+	if cfg.monitor == nil {
+		return fmt.Errorf("invalid config: monitor is nil")
+	}
+	if cfg.logger == nil {
+		return fmt.Errorf("invalid config: logger is nil")
+	}
+	if cfg.transCtrl == nil {
+		return fmt.Errorf("invalid config: transCtrl is nil")
+	}
+	if cfg.cache == nil && !cfg.defaultCache && (cfg.backgroundUpdater != nil || cfg.cacheDumpPath != "" || cfg.warmUpPath != "") {
+		return fmt.Errorf("invalid config: backgroundUpdater, cache dump and warm up require a cache")
+	}
+	if cfg.backgroundUpdateBatchNum <= 0 {
+		return fmt.Errorf("invalid config: backgroundUpdateBatchNum=%v must be > 0", cfg.backgroundUpdateBatchNum)
+	}
+	if cfg.backgroundUpdateParallelNum <= 0 {
+		return fmt.Errorf("invalid config: backgroundUpdateParallelNum=%v must be > 0",
+			cfg.backgroundUpdateParallelNum)
+	}
+	if cfg.backgroundUpdateTimeout <= 0 {
+		return fmt.Errorf("invalid config: backgroundUpdateTimeout=%v must be > 0", cfg.backgroundUpdateTimeout)
+	}
+	if cfg.backgroundUpdateDuration <= 0 {
+		return fmt.Errorf("invalid config: backgroundUpdateDuration=%v must be > 0", cfg.backgroundUpdateDuration)
+	}
+	if cfg.negativeCacheTTL < 0 {
+		return fmt.Errorf("invalid config: negativeCacheTTL=%v must be >= 0", cfg.negativeCacheTTL)
+	}
+	if cfg.staleWhileRevalidate < 0 {
+		return fmt.Errorf("invalid config: staleWhileRevalidate=%v must be >= 0", cfg.staleWhileRevalidate)
+	}
+	if cfg.cacheDumpPath != "" && cfg.cacheDumpDuration <= 0 {
+		return fmt.Errorf("invalid config: cacheDumpDuration=%v must be > 0", cfg.cacheDumpDuration)
+	}
+	return cfg.transCtrlConfig.validate()
+}
+
+// checkReconfigurable cfg为只应用了Reconfigure参数的空配置，设置了不可在线修改的字段时报错，
+// defaultCache初始为true，被WithCache清除说明设置了cache（包括nil）
+func (cfg *Config) checkReconfigurable() error {
+	fixed := map[string]bool{
+		"reqCodec":  cfg.reqCodec != nil,
+		"rspCodec":  cfg.rspCodec != nil,
+		"itemCodec": cfg.itemCodec != nil,
+		"cache":     cfg.cache != nil || !cfg.defaultCache,
+		"cacheDump": cfg.cacheDumpPath != "" || cfg.cacheDumpDuration != 0,
+		"warmUp":    cfg.warmUpPath != "",
+		"monitor":   cfg.monitor != nil,
+		"logger":    cfg.logger != nil,
+	}
+	for name, set := range fixed {
+		if set {
+			return fmt.Errorf("invalid reconfigure: %v can not be changed online", name)
+		}
+	}
+	return nil
+}
+
+func (t TransCtrlConfig) validate() error {
+	if t.CtrlWindow <= 0 {
+		return fmt.Errorf("invalid config: CtrlWindow=%v must be > 0", t.CtrlWindow)
+	}
+	if t.ErrThreshold < 0 || t.ErrThreshold > 1 {
+		return fmt.Errorf("invalid config: ErrThreshold=%v must be in [0, 1]", t.ErrThreshold)
+	}
+	if t.TimeoutThreshold < 0 || t.TimeoutThreshold > 1 {
+		return fmt.Errorf("invalid config: TimeoutThreshold=%v must be in [0, 1]", t.TimeoutThreshold)
+	}
+	if t.ErrDegradeRate < 0 {
+		return fmt.Errorf("invalid config: ErrDegradeRate=%v must be >= 0", t.ErrDegradeRate)
+	}
+	if t.TimeoutDegradeRate < 0 {
+		return fmt.Errorf("invalid config: TimeoutDegradeRate=%v must be >= 0", t.TimeoutDegradeRate)
+	}
+	return nil
+}
+
 // Option is a function that takes a config struct and modifies it
 type Option func(cfg *Config) error
 
@@ -69,13 +174,23 @@ func WithRspCodec(rspCodec RspCodec) Option {
 	}
 }
 
+func WithItemCodec(itemCodec ItemCodec) Option {
+	return func(cfg *Config) error {
+		cfg.itemCodec = itemCodec
+		return nil
+	}
+}
+
+// WithCache cache为nil时不缓存，此时不能开启后台更新、dump和预热
 func WithCache(cache Caching) Option {
 	return func(cfg *Config) error {
 		cfg.cache = cache
+		cfg.defaultCache = false
 		return nil
 	}
 }
 
+// WithBackgroundUpdater backgroundUpdater为nil时关闭后台更新
 func WithBackgroundUpdater(backgroundUpdater BackgroundUpdater) Option {
 	return func(cfg *Config) error {
 		cfg.backgroundUpdater = backgroundUpdater
@@ -89,3 +204,106 @@ func WithBackgroundUpdateDuration(backgroundUpdateDuration time.Duration) Option
 		return nil
 	}
 }
+
+// WithCacheDump 每隔interval将缓存原子地dump到path，关闭时也会dump一次，cache需实现CacheDumpable
+func WithCacheDump(path string, interval time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.cacheDumpPath = path
+		cfg.cacheDumpDuration = interval
+		return nil
+	}
+}
+
+// WithWarmUp Init时从path加载dump预热缓存，跳过TS早于maxAge的item（maxAge<=0不过滤），
+// refreshStale为true时BackgroundUpdater认为需要更新的item会立即在后台刷新
+func WithWarmUp(path string, maxAge time.Duration, refreshStale bool) Option {
+	return func(cfg *Config) error {
+		cfg.warmUpPath = path
+		cfg.warmUpMaxAge = maxAge
+		cfg.warmUpRefreshStale = refreshStale
+		return nil
+	}
+}
+
+func WithBackgroundUpdateBatchNum(batchNum int) Option {
+	return func(cfg *Config) error {
+		cfg.backgroundUpdateBatchNum = batchNum
+		return nil
+	}
+}
+
+func WithBackgroundUpdateParallelNum(parallelNum int) Option {
+	return func(cfg *Config) error {
+		cfg.backgroundUpdateParallelNum = parallelNum
+		return nil
+	}
+}
+
+func WithBackgroundUpdateTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.backgroundUpdateTimeout = timeout
+		return nil
+	}
+}
+
+func WithMonitor(monitor Monitor) Option {
+	return func(cfg *Config) error {
+		cfg.monitor = monitor
+		return nil
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(cfg *Config) error {
+		cfg.logger = logger
+		return nil
+	}
+}
+
+// WithTransCtrl 自定义拥塞控制，Init时会用TransCtrlConfig调用其Init
+func WithTransCtrl(transCtrl TransCtrl) Option {
+	return func(cfg *Config) error {
+		cfg.transCtrl = transCtrl
+		return nil
+	}
+}
+
+func WithTransCtrlConfig(transCtrlConfig TransCtrlConfig) Option {
+	return func(cfg *Config) error {
+		cfg.transCtrlConfig = transCtrlConfig
+		return nil
+	}
+}
+
+// WithConcurrencyLimiter 限制在途的下游调用数，为nil时不限制
+func WithConcurrencyLimiter(limiter ConcurrencyLimiter) Option {
+	return func(cfg *Config) error {
+		cfg.concurrencyLimiter = limiter
+		return nil
+	}
+}
+
+// WithRateLimiter 限制下游QPS，为nil时不限制
+func WithRateLimiter(limiter RateLimiter) Option {
+	return func(cfg *Config) error {
+		cfg.rateLimiter = limiter
+		return nil
+	}
+}
+
+// WithNegativeCache 下游没有返回的key在ttl内视为不存在，不再调用下游，ttl为0时关闭
+func WithNegativeCache(ttl time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.negativeCacheTTL = ttl
+		return nil
+	}
+}
+
+// WithStaleWhileRevalidate 超过SoftTTL但未超过SoftTTL+maxStale的item直接返回缓存数据，
+// 同时异步刷新，为0时关闭，没有设置SoftTTL的item不受影响
+func WithStaleWhileRevalidate(maxStale time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.staleWhileRevalidate = maxStale
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+package cached_caller
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucketConfig 令牌桶QPS限制配置，每个桶的容量为1秒的令牌数
+type TokenBucketConfig struct {
+	ForegroundQPS float64 // 前台独占的QPS
+	BackgroundQPS float64 // 后台独占的QPS
+	SharedQPS     float64 // 前后台共享的QPS，独占额度用完后使用
+	// BackgroundReserve 共享桶剩余令牌低于容量的该比例时后台不再使用，留给前台，取值0~1
+	BackgroundReserve float64
+}
+
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(qps float64, now time.Time) *tokenBucket {
+	capacity := math.Max(qps, 1)
+	if qps <= 0 {
+		capacity = 0
+	}
+	return &tokenBucket{rate: qps, capacity: capacity, tokens: capacity, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := math.Max(0, now.Sub(b.last).Seconds())
+	b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.rate)
+	b.last = now
+}
+
+// take 剩余令牌扣除后不低于reserve时扣除一个令牌
+func (b *tokenBucket) take(reserve float64) bool {
+	if b.tokens-1 < reserve {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// tokenBucketLimiter 前台和后台各自有独占额度，共享额度前台可以用完，后台只能用到BackgroundReserve为止，
+// 前台流量大时后台刷新自动让路
+type tokenBucketLimiter struct {
+	lock              sync.Mutex
+	now               func() time.Time
+	foreground        *tokenBucket
+	background        *tokenBucket
+	shared            *tokenBucket
+	backgroundReserve float64
+}
+
+func (c TokenBucketConfig) validate() error {
+	if c.ForegroundQPS < 0 || c.BackgroundQPS < 0 || c.SharedQPS < 0 {
+		return fmt.Errorf("invalid token bucket config: ForegroundQPS=%v, BackgroundQPS=%v, SharedQPS=%v must be >= 0",
+			c.ForegroundQPS, c.BackgroundQPS, c.SharedQPS)
+	}
+	if c.BackgroundReserve < 0 || c.BackgroundReserve > 1 {
+		return fmt.Errorf("invalid token bucket config: BackgroundReserve=%v must be in [0, 1]", c.BackgroundReserve)
+	}
+	return nil
+}
+
+// NewTokenBucketLimiter 创建令牌桶QPS限制，config非法或前台、后台没有可用额度时返回错误
+func NewTokenBucketLimiter(config TokenBucketConfig) (RateLimiter, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	l := &tokenBucketLimiter{
+		now:        time.Now,
+		foreground: newTokenBucket(config.ForegroundQPS, now),
+		background: newTokenBucket(config.BackgroundQPS, now),
+		shared:     newTokenBucket(config.SharedQPS, now),
+	}
+	l.backgroundReserve = l.shared.capacity * config.BackgroundReserve
+	if l.foreground.capacity+l.shared.capacity < 1 {
+		return nil, fmt.Errorf("invalid token bucket config: foreground has no budget, " +
+			"ForegroundQPS or SharedQPS must be > 0")
+	}
+	if l.background.capacity < 1 && l.shared.capacity-l.backgroundReserve < 1 {
+		return nil, fmt.Errorf("invalid token bucket config: background has no budget, " +
+			"BackgroundQPS must be > 0 or SharedQPS must leave at least 1 token above BackgroundReserve")
+	}
+	return l, nil
+}
+
+func (l *tokenBucketLimiter) Allow(t TrafficType) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.foreground.refill(now)
+	l.background.refill(now)
+	l.shared.refill(now)
+	if t == TrafficBackground {
+		return l.background.take(0) || l.shared.take(l.backgroundReserve)
+	}
+	return l.foreground.take(0) || l.shared.take(0)
+}
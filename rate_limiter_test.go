@@ -0,0 +1,74 @@
+package cached_caller
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter, err := NewTokenBucketLimiter(TokenBucketConfig{
+		ForegroundQPS:     2,
+		BackgroundQPS:     1,
+		SharedQPS:         4,
+		BackgroundReserve: 0.5,
+	})
+	assert.Nil(t, err)
+	l := limiter.(*tokenBucketLimiter)
+	l.now = func() time.Time { return now }
+	allowed := func(traffic TrafficType) int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			if l.Allow(traffic) {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Equal(t, 3, allowed(TrafficBackground))
+	assert.Equal(t, 4, allowed(TrafficForeground))
+	assert.Equal(t, 0, allowed(TrafficBackground))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, 6, allowed(TrafficForeground))
+	assert.Equal(t, 1, allowed(TrafficBackground))
+}
+
+func TestTokenBucketLimiterInvalidConfig(t *testing.T) {
+	for _, config := range []TokenBucketConfig{
+		{ForegroundQPS: -1, BackgroundQPS: 1},
+		{ForegroundQPS: 1, BackgroundQPS: 1, BackgroundReserve: 2},
+		{BackgroundQPS: 1},
+		{ForegroundQPS: 1},
+		{SharedQPS: 1, BackgroundReserve: 0.5},
+	} {
+		_, err := NewTokenBucketLimiter(config)
+		assert.NotNil(t, err, "%+v", config)
+	}
+	_, err := NewTokenBucketLimiter(TokenBucketConfig{SharedQPS: 10, BackgroundReserve: 0.5})
+	assert.Nil(t, err)
+}
+
+func TestRateLimitDegrade(t *testing.T) {
+	c := NewCachedCaller()
+	cc := &CountFeatureCaller{}
+	limiter, err := NewTokenBucketLimiter(TokenBucketConfig{ForegroundQPS: 1, BackgroundQPS: 1})
+	assert.Nil(t, err)
+	err = c.Init(cc, WithReqCodec(&FeatureReqCodec{}), WithRspCodec(&FeatureRspCodec{}),
+		WithCache(newTestCaching()),
+		WithRateLimiter(limiter))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	for _, id := range []string{"111", "222"} {
+		rsp, err := c.Call(context.Background(), time.Second, &FeatureRequest{
+			itemInfos: []*ItemInfo{{ItemID: id}},
+		})
+		assert.Nil(t, err)
+		assert.NotNil(t, rsp)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cc.callCnt))
+}
@@ -0,0 +1,263 @@
+package cached_caller
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+// PluginParams 配置文件中插件的参数
+type PluginParams map[string]interface{}
+
+// CacheFactory 根据参数创建缓存
+type CacheFactory func(params PluginParams) (Caching, error)
+
+// BackgroundUpdaterFactory 根据参数创建后台更新判断，返回nil表示关闭后台更新
+type BackgroundUpdaterFactory func(params PluginParams) (BackgroundUpdater, error)
+
+// MonitorFactory 根据参数创建监控
+type MonitorFactory func(params PluginParams) (Monitor, error)
+
+// TransCtrlFactory 根据参数创建拥塞控制
+type TransCtrlFactory func(params PluginParams) (TransCtrl, error)
+
+var (
+	registryLock               sync.RWMutex
+	cacheFactories             = map[string]CacheFactory{}
+	backgroundUpdaterFactories = map[string]BackgroundUpdaterFactory{}
+	monitorFactories           = map[string]MonitorFactory{}
+	transCtrlFactories         = map[string]TransCtrlFactory{}
+)
+
+// RegisterCache 注册缓存实现，配置文件中通过name选择
+func RegisterCache(name string, factory CacheFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	cacheFactories[name] = factory
+}
+
+// RegisterBackgroundUpdater 注册后台更新判断实现
+func RegisterBackgroundUpdater(name string, factory BackgroundUpdaterFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	backgroundUpdaterFactories[name] = factory
+}
+
+// RegisterMonitor 注册监控实现
+func RegisterMonitor(name string, factory MonitorFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	monitorFactories[name] = factory
+}
+
+// RegisterTransCtrl 注册拥塞控制实现
+func RegisterTransCtrl(name string, factory TransCtrlFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	transCtrlFactories[name] = factory
+}
+
+func newCacheByName(name string, params PluginParams) (Caching, error) {
+	registryLock.RLock()
+	factory, ok := cacheFactories[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("cache %v not registered", name)
+	}
+	return factory(params)
+}
+
+func newBackgroundUpdaterByName(name string, params PluginParams) (BackgroundUpdater, error) {
+	registryLock.RLock()
+	factory, ok := backgroundUpdaterFactories[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("background updater %v not registered", name)
+	}
+	return factory(params)
+}
+
+func newMonitorByName(name string, params PluginParams) (Monitor, error) {
+	registryLock.RLock()
+	factory, ok := monitorFactories[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("monitor %v not registered", name)
+	}
+	return factory(params)
+}
+
+func newTransCtrlByName(name string, params PluginParams) (TransCtrl, error) {
+	registryLock.RLock()
+	factory, ok := transCtrlFactories[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("trans ctrl %v not registered", name)
+	}
+	return factory(params)
+}
+
+// Int 读取整数参数，不存在时返回def
+func (p PluginParams) Int(key string, def int) (int, error) {
+	v, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int64:
+		return int(n), nil
+	case uint64:
+		return int(n), nil
+	case float64:
+		if n != float64(int(n)) {
+			return 0, fmt.Errorf("param %v=%v is not an integer", key, v)
+		}
+		return int(n), nil
+	case string:
+		return strconv.Atoi(n)
+	}
+	return 0, fmt.Errorf("param %v=%v is not an integer", key, v)
+}
+
+// Float 读取浮点数参数，不存在时返回def
+func (p PluginParams) Float(key string, def float64) (float64, error) {
+	v, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("param %v=%v is not a number", key, v)
+}
+
+// Duration 读取时长参数，格式同time.ParseDuration，例如"10m"
+func (p PluginParams) Duration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("param %v=%v is not a duration string", key, v)
+	}
+	return time.ParseDuration(str)
+}
+
+func init() {
+	RegisterCache("bigcache", newBigCachingFromParams)
+	RegisterBackgroundUpdater("default", func(params PluginParams) (BackgroundUpdater, error) {
+		maxAge, err := params.Duration("max_age", defaultBackgroundUpdateMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		return &defaultBackgroundUpdater{maxAge: maxAge}, nil
+	})
+	RegisterBackgroundUpdater("none", func(params PluginParams) (BackgroundUpdater, error) {
+		return nil, nil
+	})
+	RegisterMonitor("default", func(params PluginParams) (Monitor, error) {
+		return &defaultMonitor{}, nil
+	})
+	RegisterTransCtrl("default", func(params PluginParams) (TransCtrl, error) {
+		return &defaultTransCtrl{}, nil
+	})
+	RegisterTransCtrl("circuit_breaker", newCircuitBreakerFromParams)
+	RegisterTransCtrl("latency", newLatencyTransCtrlFromParams)
+}
+
+// newLatencyTransCtrlFromParams 支持参数：window、percentile、min_sample_num、degrade_start、max_degrade_rate
+func newLatencyTransCtrlFromParams(params PluginParams) (TransCtrl, error) {
+	c := DefaultLatencyCtrlConfig()
+	var err error
+	c.Window, err = params.Duration("window", c.Window)
+	if err != nil {
+		return nil, err
+	}
+	c.MinSampleNum, err = params.Int("min_sample_num", c.MinSampleNum)
+	if err != nil {
+		return nil, err
+	}
+	for key, field := range map[string]*float64{
+		"percentile":       &c.Percentile,
+		"degrade_start":    &c.DegradeStart,
+		"max_degrade_rate": &c.MaxDegradeRate,
+	} {
+		*field, err = params.Float(key, *field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewLatencyTransCtrl(c, nil), nil
+}
+
+// newCircuitBreakerFromParams 支持参数：bucket_num、bucket_duration、min_request_num、open_duration、
+// half_open_probe_num
+func newCircuitBreakerFromParams(params PluginParams) (TransCtrl, error) {
+	c := DefaultCircuitBreakerConfig()
+	var err error
+	for key, field := range map[string]*int{
+		"bucket_num":          &c.BucketNum,
+		"min_request_num":     &c.MinRequestNum,
+		"half_open_probe_num": &c.HalfOpenProbeNum,
+	} {
+		*field, err = params.Int(key, *field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for key, field := range map[string]*time.Duration{
+		"bucket_duration": &c.BucketDuration,
+		"open_duration":   &c.OpenDuration,
+	} {
+		*field, err = params.Duration(key, *field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+	return NewCircuitBreaker(c, nil, nil), nil
+}
+
+// newBigCachingFromParams 支持参数：shards、life_window、clean_window、max_entries_in_window、
+// max_entry_size、hard_max_cache_size(MB)
+func newBigCachingFromParams(params PluginParams) (Caching, error) {
+	lifeWindow, err := params.Duration("life_window", defaultConfig.LifeWindow)
+	if err != nil {
+		return nil, err
+	}
+	c := bigcache.DefaultConfig(lifeWindow)
+	c.CleanWindow, err = params.Duration("clean_window", c.CleanWindow)
+	if err != nil {
+		return nil, err
+	}
+	for key, field := range map[string]*int{
+		"shards":                &c.Shards,
+		"max_entries_in_window": &c.MaxEntriesInWindow,
+		"max_entry_size":        &c.MaxEntrySize,
+		"hard_max_cache_size":   &c.HardMaxCacheSize,
+	} {
+		*field, err = params.Int(key, *field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newBigCaching(c)
+}
@@ -0,0 +1,67 @@
+package cached_caller
+
+import (
+	"sync"
+)
+
+// defaultRevalidateQueueSize 等待异步刷新的item数上限，超过时丢弃
+const defaultRevalidateQueueSize = 10000
+
+// revalidator 返回过期数据后等待异步刷新的item队列，同一key在刷新完成前只入队一次
+type revalidator struct {
+	mu      sync.Mutex
+	pending map[string]struct{}
+	queue   chan *Item
+}
+
+func newRevalidator(size int) *revalidator {
+	return &revalidator{
+		pending: make(map[string]struct{}),
+		queue:   make(chan *Item, size),
+	}
+}
+
+// enqueue 返回是否入队，key已在队列中时ok为false，队列已满时full为true
+func (r *revalidator) enqueue(item *Item) (ok bool, full bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.pending[item.Key]; ok {
+		return false, false
+	}
+	select {
+	case r.queue <- item:
+		r.pending[item.Key] = struct{}{}
+		return true, false
+	default:
+		return false, true
+	}
+}
+
+// next 阻塞获取一个item后再非阻塞地取出最多batchNum-1个，done关闭时返回nil
+func (r *revalidator) next(batchNum int, done <-chan struct{}) []*Item {
+	var batch []*Item
+	select {
+	case item := <-r.queue:
+		batch = append(batch, item)
+	case <-done:
+		return nil
+	}
+	for len(batch) < batchNum {
+		select {
+		case item := <-r.queue:
+			batch = append(batch, item)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// finish 刷新完成，之后同一key可以再次入队
+func (r *revalidator) finish(items []*Item) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, item := range items {
+		delete(r.pending, item.Key)
+	}
+}
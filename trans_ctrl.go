@@ -5,10 +5,11 @@ import (
 	"sync/atomic"
 )
 
+// defaultTransCtrl 配置字段均原子读写，Reconfigure时可以在运行中重新Init
 type defaultTransCtrl struct {
 	ctrlWindow       uint64
-	errThreshold     float64
-	timeoutThreshold float64
+	errThreshold     uint64 // float64 bits
+	timeoutThreshold uint64 // float64 bits
 	errCnt           uint64
 	timeoutCnt       uint64
 	total            uint64
@@ -18,26 +19,25 @@ type defaultTransCtrl struct {
 }
 
 func (d *defaultTransCtrl) errRateDegradeFlag() bool {
-	errCnt := float64(d.errCnt)
-	total := float64(d.total)
+	errCnt := float64(atomic.LoadUint64(&d.errCnt))
+	total := float64(atomic.LoadUint64(&d.total))
 	if total <= 0 {
 		return false
 	}
-	return errCnt/total > d.errThreshold
+	return errCnt/total > math.Float64frombits(atomic.LoadUint64(&d.errThreshold))
 }
 
 func (d *defaultTransCtrl) timeoutRateDegradeFlag() bool {
-	timeoutCnt := float64(d.timeoutCnt)
-	total := float64(d.total)
+	timeoutCnt := float64(atomic.LoadUint64(&d.timeoutCnt))
+	total := float64(atomic.LoadUint64(&d.total))
 	if total <= 0 {
 		return false
 	}
-	return timeoutCnt/total > d.timeoutThreshold
+	return timeoutCnt/total > math.Float64frombits(atomic.LoadUint64(&d.timeoutThreshold))
 }
 
 func (d *defaultTransCtrl) Report(t TransType) {
-	atomic.AddUint64(&d.total, 1)
-	total := d.total
+	total := atomic.AddUint64(&d.total, 1)
 	switch t {
 	case TransTypeFail:
 		atomic.AddUint64(&d.errCnt, 1)
@@ -45,12 +45,12 @@ func (d *defaultTransCtrl) Report(t TransType) {
 		atomic.AddUint64(&d.timeoutCnt, 1)
 	}
 	if d.errRateDegradeFlag() {
-		atomic.AddUint64(&d.degradeCnt, d.errDegrade)
+		atomic.AddUint64(&d.degradeCnt, atomic.LoadUint64(&d.errDegrade))
 	}
 	if d.timeoutRateDegradeFlag() {
-		atomic.AddUint64(&d.degradeCnt, d.timeoutDegrade)
+		atomic.AddUint64(&d.degradeCnt, atomic.LoadUint64(&d.timeoutDegrade))
 	}
-	if total > d.ctrlWindow {
+	if total > atomic.LoadUint64(&d.ctrlWindow) {
 		atomic.StoreUint64(&d.total, 0)
 		atomic.StoreUint64(&d.errCnt, 0)
 		atomic.StoreUint64(&d.timeoutCnt, 0)
@@ -65,11 +65,16 @@ func (d *defaultTransCtrl) Degrade() bool {
 	return false
 }
 
+// Degrading 还有未消耗的降级名额
+func (d *defaultTransCtrl) Degrading() bool {
+	return atomic.LoadUint64(&d.degradeCnt) > 0
+}
+
 func (d *defaultTransCtrl) Init(config TransCtrlConfig) error {
-	d.ctrlWindow = uint64(config.ctrlWindow)
-	d.errDegrade = uint64(math.Ceil(config.errDegradeRate))
-	d.timeoutDegrade = uint64(math.Ceil(config.timeoutDegradeRate))
-	d.errThreshold = config.errThreshold
-	d.timeoutThreshold = config.timeoutThreshold
+	atomic.StoreUint64(&d.ctrlWindow, uint64(config.CtrlWindow))
+	atomic.StoreUint64(&d.errDegrade, uint64(math.Ceil(config.ErrDegradeRate)))
+	atomic.StoreUint64(&d.timeoutDegrade, uint64(math.Ceil(config.TimeoutDegradeRate)))
+	atomic.StoreUint64(&d.errThreshold, math.Float64bits(config.ErrThreshold))
+	atomic.StoreUint64(&d.timeoutThreshold, math.Float64bits(config.TimeoutThreshold))
 	return nil
 }
@@ -0,0 +1,166 @@
+package cached_caller
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TypedCaller 类型安全的请求方法
+type TypedCaller[Q, R any] interface {
+	Call(ctx context.Context, timeout time.Duration, req Q) (rsp R, err error)
+}
+
+// TypedReqCodec 类型安全的请求包编解码
+type TypedReqCodec[Q any] interface {
+	Encode(req Q) (items []*Item, err error)
+	Decode(items []*Item) (req Q, err error)
+}
+
+// TypedRspCodec 类型安全的回包编解码
+type TypedRspCodec[R any] interface {
+	Encode(rsp R) (items []*Item, err error)
+	Decode(items []*Item) (rsp R, err error)
+}
+
+// TypedMissReqBuilder 同MissReqBuilder，TypedReqCodec的可选扩展
+type TypedMissReqBuilder[Q any] interface {
+	BuildMissReq(req Q, items []*Item) (missReq Q, err error)
+}
+
+// TypedCachedCaller 类型安全的带缓存调用，请求和回包类型不匹配时编译失败
+type TypedCachedCaller[Q, R any] interface {
+	TypedCaller[Q, R]
+	Closer
+	Reconfigurer
+	CallWithMeta(ctx context.Context, timeout time.Duration, req Q) (rsp R, meta CallMeta, err error)
+	CallInCache(req Q) (rsp R, err error)
+}
+
+// NewTypedCachedCaller 创建并初始化类型安全的CachedCaller，opts中的WithReqCodec、WithRspCodec会被忽略
+func NewTypedCachedCaller[Q, R any](caller TypedCaller[Q, R], reqCodec TypedReqCodec[Q], rspCodec TypedRspCodec[R],
+	opts ...Option) (TypedCachedCaller[Q, R], error) {
+	if caller == nil || reqCodec == nil || rspCodec == nil {
+		return nil, fmt.Errorf("caller, reqCodec and rspCodec must not be nil")
+	}
+	impl := &cachedCallerImpl{}
+	opts = append(opts,
+		WithReqCodec(UntypedReqCodec(reqCodec)),
+		WithRspCodec(UntypedRspCodec(rspCodec)))
+	err := impl.Init(&typedCaller[Q, R]{caller: caller}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &typedCachedCaller[Q, R]{impl: impl}, nil
+}
+
+type typedCachedCaller[Q, R any] struct {
+	impl *cachedCallerImpl
+}
+
+func (t *typedCachedCaller[Q, R]) Call(ctx context.Context, timeout time.Duration, req Q) (R, error) {
+	rsp, err := t.impl.Call(ctx, timeout, req)
+	return typedRsp[R](rsp), err
+}
+
+func (t *typedCachedCaller[Q, R]) CallWithMeta(ctx context.Context, timeout time.Duration, req Q) (R, CallMeta, error) {
+	rsp, meta, err := t.impl.CallWithMeta(ctx, timeout, req)
+	return typedRsp[R](rsp), meta, err
+}
+
+func (t *typedCachedCaller[Q, R]) CallInCache(req Q) (R, error) {
+	rsp, err := t.impl.CallInCache(req)
+	return typedRsp[R](rsp), err
+}
+
+// Reconfigure 同CachedCaller，WithReqCodec、WithRspCodec不可修改
+func (t *typedCachedCaller[Q, R]) Reconfigure(opts ...Option) error {
+	return t.impl.Reconfigure(opts...)
+}
+
+func (t *typedCachedCaller[Q, R]) Close(ctx context.Context) error {
+	return t.impl.Close(ctx)
+}
+
+// typedRsp 出错时rsp可能为nil，返回R的零值
+func typedRsp[R any](rsp Rsp) R {
+	r, _ := rsp.(R)
+	return r
+}
+
+// typedCaller 以下适配器只会收到对应类型的Req、Rsp，类型断言失败说明内部逻辑有误
+type typedCaller[Q, R any] struct {
+	caller TypedCaller[Q, R]
+}
+
+func (t *typedCaller[Q, R]) Call(ctx context.Context, timeout time.Duration, req Req) (Rsp, error) {
+	q, ok := req.(Q)
+	if !ok {
+		return nil, fmt.Errorf("unexpected req type %T", req)
+	}
+	return t.caller.Call(ctx, timeout, q)
+}
+
+// UntypedReqCodec 将TypedReqCodec转为ReqCodec，用于WithReqCodec
+func UntypedReqCodec[Q any](codec TypedReqCodec[Q]) ReqCodec {
+	return &typedReqCodec[Q]{codec: codec}
+}
+
+// UntypedRspCodec 将TypedRspCodec转为RspCodec，用于WithRspCodec
+func UntypedRspCodec[R any](codec TypedRspCodec[R]) RspCodec {
+	return &typedRspCodec[R]{codec: codec}
+}
+
+type typedReqCodec[Q any] struct {
+	codec TypedReqCodec[Q]
+}
+
+func (t *typedReqCodec[Q]) Encode(req Req) ([]*Item, error) {
+	q, ok := req.(Q)
+	if !ok {
+		return nil, fmt.Errorf("unexpected req type %T", req)
+	}
+	return t.codec.Encode(q)
+}
+
+func (t *typedReqCodec[Q]) Decode(items []*Item) (Req, error) {
+	return t.codec.Decode(items)
+}
+
+// BuildMissReq codec没有实现TypedMissReqBuilder时同Decode
+func (t *typedReqCodec[Q]) BuildMissReq(req Req, items []*Item) (Req, error) {
+	builder, ok := t.codec.(TypedMissReqBuilder[Q])
+	if !ok {
+		return t.codec.Decode(items)
+	}
+	q, ok := req.(Q)
+	if !ok {
+		return nil, fmt.Errorf("unexpected req type %T", req)
+	}
+	return builder.BuildMissReq(q, items)
+}
+
+type typedRspCodec[R any] struct {
+	codec TypedRspCodec[R]
+}
+
+func (t *typedRspCodec[R]) Encode(rsp Rsp) ([]*Item, error) {
+	r, ok := rsp.(R)
+	if !ok {
+		return nil, fmt.Errorf("unexpected rsp type %T", rsp)
+	}
+	return t.codec.Encode(r)
+}
+
+func (t *typedRspCodec[R]) Decode(items []*Item) (Rsp, error) {
+	return t.codec.Decode(items)
+}
+
+// CheckItem codec没有实现ItemChecker时不检查
+func (t *typedRspCodec[R]) CheckItem(item *Item) error {
+	checker, ok := t.codec.(ItemChecker)
+	if !ok {
+		return nil
+	}
+	return checker.CheckItem(item)
+}
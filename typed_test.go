@@ -0,0 +1,80 @@
+package cached_caller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type typedFeatureReqCodec struct {
+	FeatureReqCodec
+}
+
+func (v *typedFeatureReqCodec) Encode(req *FeatureRequest) ([]*Item, error) {
+	return v.FeatureReqCodec.Encode(req)
+}
+
+func (v *typedFeatureReqCodec) Decode(items []*Item) (*FeatureRequest, error) {
+	req, err := v.FeatureReqCodec.Decode(items)
+	if err != nil {
+		return nil, err
+	}
+	return req.(*FeatureRequest), nil
+}
+
+type typedFeatureRspCodec struct {
+	FeatureRspCodec
+}
+
+func (v *typedFeatureRspCodec) Encode(rsp *FeatureResponse) ([]*Item, error) {
+	return v.FeatureRspCodec.Encode(rsp)
+}
+
+func (v *typedFeatureRspCodec) Decode(items []*Item) (*FeatureResponse, error) {
+	rsp, err := v.FeatureRspCodec.Decode(items)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.(*FeatureResponse), nil
+}
+
+type typedFeatureCaller struct {
+	client  *FeatureCenterServer
+	callCnt int
+}
+
+func (v *typedFeatureCaller) Call(ctx context.Context, timeout time.Duration, req *FeatureRequest) (*FeatureResponse, error) {
+	v.callCnt++
+	return v.client.GetFeature(req)
+}
+
+func TestTypedCachedCaller(t *testing.T) {
+	caller := &typedFeatureCaller{}
+	c, err := NewTypedCachedCaller[*FeatureRequest, *FeatureResponse](caller,
+		&typedFeatureReqCodec{}, &typedFeatureRspCodec{},
+		WithCache(newTestCaching()),
+	)
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	req := &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "111"}, {ItemID: "222"}}}
+	rsp, err := c.Call(context.Background(), time.Second, req)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rsp.itemInfos))
+	assert.Equal(t, fid1Value, rsp.itemInfos[0].Feature[fid1].IntVal)
+
+	rsp, meta, err := c.CallWithMeta(context.Background(), time.Second, req)
+	assert.Nil(t, err)
+	assert.Equal(t, fid1Value, rsp.itemInfos[1].Feature[fid1].IntVal)
+	assert.Equal(t, ItemSourceCache, meta["222"].Source)
+	assert.Equal(t, 1, caller.callCnt)
+
+	rsp, err = c.CallInCache(req)
+	assert.Nil(t, err)
+	assert.Equal(t, fid1Value, rsp.itemInfos[0].Feature[fid1].IntVal)
+	assert.Nil(t, c.Reconfigure(WithBackgroundUpdateBatchNum(10)))
+
+	_, err = NewTypedCachedCaller[*FeatureRequest, *FeatureResponse](caller, nil, &typedFeatureRspCodec{})
+	assert.NotNil(t, err)
+}
@@ -1,20 +1,23 @@
 package utils
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
 var (
 	nowTS  int64
-	nowStr string
+	nowStr atomic.Value
 )
 
 // NowTS 获取当前时间
 func NowTS() int64 {
-	return nowTS
+	return atomic.LoadInt64(&nowTS)
 }
 
 // NowStr 获取当前时间字符串
 func NowStr() string {
-	return nowStr
+	return nowStr.Load().(string)
 }
 
 func init() {
@@ -27,6 +30,6 @@ func init() {
 }
 
 func initTS() {
-	nowTS = time.Now().Unix()
-	nowStr = time.Now().Format("2006-01-02 15:04:05")
+	atomic.StoreInt64(&nowTS, time.Now().Unix())
+	nowStr.Store(time.Now().Format("2006-01-02 15:04:05"))
 }
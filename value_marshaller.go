@@ -0,0 +1,201 @@
+package cached_caller
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/davidhacking/cached_caller/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// ValueMarshaller Item.Data的序列化方式，Unmarshal的v为指向记录的指针
+type ValueMarshaller interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONMarshaller 使用encoding/json序列化
+type JSONMarshaller struct{}
+
+func (JSONMarshaller) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONMarshaller) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobMarshaller 使用encoding/gob序列化，每条记录单独编码，包含类型信息，比JSON大
+type GobMarshaller struct{}
+
+func (GobMarshaller) Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobMarshaller) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// schemaMagic 带schema的数据格式为 magic(1) | schemaLen(1) | schema | payload
+const (
+	schemaMagic     = byte(0x84)
+	schemaMaxLen    = 255
+	schemaHeaderLen = 1 + 1
+)
+
+func appendSchema(schema string, payload []byte) []byte {
+	data := make([]byte, 0, schemaHeaderLen+len(schema)+len(payload))
+	data = append(data, schemaMagic, byte(len(schema)))
+	data = append(data, schema...)
+	return append(data, payload...)
+}
+
+// trimSchema schema不一致或没有schema时返回ErrSchemaMismatch
+func trimSchema(schema string, data []byte) ([]byte, error) {
+	if len(data) < schemaHeaderLen || data[0] != schemaMagic {
+		return nil, errors.ErrSchemaMismatch
+	}
+	n := int(data[1])
+	if len(data) < schemaHeaderLen+n {
+		return nil, errors.ErrItemFormat
+	}
+	if string(data[schemaHeaderLen:schemaHeaderLen+n]) != schema {
+		return nil, errors.ErrSchemaMismatch
+	}
+	return data[schemaHeaderLen+n:], nil
+}
+
+// schemaChecker 带schema的ValueMarshaller只检查schema是否一致，不解码数据，v同Unmarshal
+type schemaChecker interface {
+	checkSchema(data []byte, v interface{}) error
+}
+
+type versionedMarshaller struct {
+	marshaller ValueMarshaller
+	schema     string
+}
+
+// NewVersionedMarshaller 在数据前写入schema，例如"ItemInfo@v2"，记录类型变化时修改schema，
+// 读取到schema不一致或没有schema的旧数据时Unmarshal返回ErrSchemaMismatch
+func NewVersionedMarshaller(marshaller ValueMarshaller, schema string) (ValueMarshaller, error) {
+	if marshaller == nil {
+		return nil, fmt.Errorf("marshaller is nil")
+	}
+	if schema == "" || len(schema) > schemaMaxLen {
+		return nil, fmt.Errorf("invalid schema %q, length must be in [1, %v]", schema, schemaMaxLen)
+	}
+	return &versionedMarshaller{marshaller: marshaller, schema: schema}, nil
+}
+
+func (m *versionedMarshaller) Marshal(v interface{}) ([]byte, error) {
+	payload, err := m.marshaller.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendSchema(m.schema, payload), nil
+}
+
+func (m *versionedMarshaller) Unmarshal(data []byte, v interface{}) error {
+	payload, err := trimSchema(m.schema, data)
+	if err != nil {
+		return err
+	}
+	return m.marshaller.Unmarshal(payload, v)
+}
+
+func (m *versionedMarshaller) checkSchema(data []byte, v interface{}) error {
+	_, err := trimSchema(m.schema, data)
+	return err
+}
+
+// ProtoMarshaller 使用protobuf序列化proto.Message，schema为消息全名，Version不为空时为"全名@Version"，
+// 消息类型变化时自动不匹配，同一消息的字段含义变化时需要修改Version
+type ProtoMarshaller struct {
+	Version string
+}
+
+func (m ProtoMarshaller) schema(msg proto.Message) string {
+	name := string(msg.ProtoReflect().Descriptor().FullName())
+	if m.Version == "" {
+		return name
+	}
+	return name + "@" + m.Version
+}
+
+func (m ProtoMarshaller) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not proto.Message", v)
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return appendSchema(m.schema(msg), payload), nil
+}
+
+// Unmarshal v可以是proto.Message，也可以是指向proto.Message指针的指针，为nil时解码成功后自动创建
+func (m ProtoMarshaller) Unmarshal(data []byte, v interface{}) error {
+	msg, created, err := protoMessageOf(v)
+	if err != nil {
+		return err
+	}
+	err = m.unmarshal(data, msg)
+	if err != nil {
+		return err
+	}
+	if created.IsValid() {
+		reflect.ValueOf(v).Elem().Set(created)
+	}
+	return nil
+}
+
+func (m ProtoMarshaller) checkSchema(data []byte, v interface{}) error {
+	msg, _, err := protoMessageOf(v)
+	if err != nil {
+		return err
+	}
+	_, err = trimSchema(m.schema(msg), data)
+	return err
+}
+
+// protoMessageOf 返回v对应的proto.Message，v指向的指针为nil时新建消息，created为新建的消息
+func protoMessageOf(v interface{}) (msg proto.Message, created reflect.Value, err error) {
+	if msg, ok := v.(proto.Message); ok {
+		return msg, reflect.Value{}, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Ptr {
+		return nil, reflect.Value{}, fmt.Errorf("%T is not proto.Message", v)
+	}
+	elem := rv.Elem()
+	if !elem.IsNil() {
+		msg, ok := elem.Interface().(proto.Message)
+		if !ok {
+			return nil, reflect.Value{}, fmt.Errorf("%T is not proto.Message", v)
+		}
+		return msg, reflect.Value{}, nil
+	}
+	created = reflect.New(elem.Type().Elem())
+	msg, ok := created.Interface().(proto.Message)
+	if !ok {
+		return nil, reflect.Value{}, fmt.Errorf("%T is not proto.Message", v)
+	}
+	return msg, created, nil
+}
+
+func (m ProtoMarshaller) unmarshal(data []byte, msg proto.Message) error {
+	payload, err := trimSchema(m.schema(msg), data)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(payload, msg)
+}
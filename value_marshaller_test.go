@@ -0,0 +1,88 @@
+package cached_caller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/davidhacking/cached_caller/errors"
+	"github.com/davidhacking/cached_caller/utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestVersionedMarshaller(t *testing.T) {
+	v1, err := NewVersionedMarshaller(JSONMarshaller{}, "ItemInfo@v1")
+	assert.Nil(t, err)
+	v2, err := NewVersionedMarshaller(JSONMarshaller{}, "ItemInfo@v2")
+	assert.Nil(t, err)
+	data, err := v1.Marshal(&ItemInfo{ItemID: "111"})
+	assert.Nil(t, err)
+	info := &ItemInfo{}
+	assert.Nil(t, v1.Unmarshal(data, info))
+	assert.Equal(t, "111", info.ItemID)
+	assert.True(t, errors.Is(v2.Unmarshal(data, &ItemInfo{}), errors.ErrSchemaMismatch))
+
+	// 没有schema的旧数据
+	data, err = JSONMarshaller{}.Marshal(&ItemInfo{ItemID: "111"})
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(v1.Unmarshal(data, &ItemInfo{}), errors.ErrSchemaMismatch))
+
+	_, err = NewVersionedMarshaller(JSONMarshaller{}, "")
+	assert.NotNil(t, err)
+}
+
+func TestProtoMarshaller(t *testing.T) {
+	m := ProtoMarshaller{Version: "v1"}
+	data, err := m.Marshal(wrapperspb.String("value"))
+	assert.Nil(t, err)
+	var msg *wrapperspb.StringValue
+	assert.Nil(t, m.Unmarshal(data, &msg))
+	assert.Equal(t, "value", msg.GetValue())
+
+	// 消息类型或Version变化时不匹配，目标保持为nil
+	var other *wrapperspb.BytesValue
+	assert.True(t, errors.Is(m.Unmarshal(data, &other), errors.ErrSchemaMismatch))
+	assert.Nil(t, other)
+	assert.True(t, errors.Is(ProtoMarshaller{Version: "v2"}.Unmarshal(data, &wrapperspb.StringValue{}),
+		errors.ErrSchemaMismatch))
+	assert.Nil(t, m.checkSchema(data, &msg))
+	assert.True(t, errors.Is(m.checkSchema(data, &other), errors.ErrSchemaMismatch))
+
+	_, err = m.Marshal(&ItemInfo{})
+	assert.NotNil(t, err)
+}
+
+func TestBatchCodecSchemaMismatch(t *testing.T) {
+	v1, err := NewVersionedMarshaller(JSONMarshaller{}, "ItemInfo@v1")
+	assert.Nil(t, err)
+	v2, err := NewVersionedMarshaller(JSONMarshaller{}, "ItemInfo@v2")
+	assert.Nil(t, err)
+	items, err := newFeatureBatchCodec(t, v1).RspCodec().Encode(&FeatureResponse{
+		itemInfos: []*ItemInfo{{ItemID: "111", Feature: map[int32]*Feature{fid1: {IntVal: fid1Value}}}}})
+	assert.Nil(t, err)
+	rsp, err := newFeatureBatchCodec(t, v2).RspCodec().Decode(items)
+	assert.Nil(t, err)
+	assert.Equal(t, "111", rsp.itemInfos[0].ItemID)
+	assert.Nil(t, rsp.itemInfos[0].Feature)
+
+	// schema不匹配的缓存数据按未命中处理，调用下游后覆盖
+	cache := newTestCaching()
+	items[0].TS = utils.NowTS()
+	key, value, err := (&defaultItemCodec{}).Encode(items[0])
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Put(key, value))
+	codec := newFeatureBatchCodec(t, v2)
+	caller := &recordFeatureCaller{}
+	c, err := NewTypedCachedCaller[*FeatureRequest, *FeatureResponse](caller, codec.ReqCodec(), codec.RspCodec(),
+		WithCache(cache))
+	assert.Nil(t, err)
+	defer c.Close(context.Background())
+	req := &FeatureRequest{itemInfos: []*ItemInfo{{ItemID: "111"}}}
+	for i := 0; i < 2; i++ {
+		rsp, err = c.Call(context.Background(), time.Second, req)
+		assert.Nil(t, err)
+		assert.Equal(t, fid1Value, rsp.itemInfos[0].Feature[fid1].IntVal)
+	}
+	assert.Equal(t, 1, len(caller.reqs))
+}